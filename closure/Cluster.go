@@ -1,6 +1,8 @@
 package closure
 
 import (
+	"slices"
+
 	"github.com/SwanHtetAungPhyo/swantemp/utils"
 )
 
@@ -19,19 +21,26 @@ func NewCluster(prefix string, router *Router, mw ...Middleware) *Cluster {
 	}
 }
 
+// Group creates a child cluster under subPrefix and runs block to register its routes.
+// Routes of the child run the parent's middleware once, outermost, followed by the
+// child's own.
 func (c *Cluster) Group(subPrefix string, block func(*Cluster)) *Cluster {
 	fullPrefix := utils.JoinPaths(c.prefix, subPrefix)
 	child := &Cluster{
-		prefix:     fullPrefix,
-		router:     c.router,
-		parent:     c,
-		middleware: make([]Middleware, len(c.middleware)),
+		prefix: fullPrefix,
+		router: c.router,
+		parent: c,
 	}
-	_ = copy(child.middleware, c.middleware)
 	block(child)
 	return child
 }
 
+// Use adds middleware to the cluster and its groups. Handlers are wrapped when they
+// are registered, so it only applies to routes registered afterwards.
+func (c *Cluster) Use(mw ...Middleware) {
+	c.middleware = append(c.middleware, mw...)
+}
+
 func (c *Cluster) applyMiddleware(handler Handler) Handler {
 	middlewares := c.collectMiddleware()
 
@@ -41,45 +50,54 @@ func (c *Cluster) applyMiddleware(handler Handler) Handler {
 	return handler
 }
 
+// collectMiddleware returns the middleware of c and its parents, outermost first
 func (c *Cluster) collectMiddleware() []Middleware {
-	var mws []Middleware
-	current := c
-
-	for current != nil {
-		mws = append(mws, current.middleware...)
-		current = current.parent
+	if c.parent == nil {
+		return c.middleware
 	}
-
-	return mws
+	return slices.Concat(c.parent.collectMiddleware(), c.middleware)
 }
 
-func (c *Cluster) registerRoute(method, path string, handler Handler) {
+// registerRoute wraps handler with the route middleware first and the cluster middleware around it
+func (c *Cluster) registerRoute(method, path string, handler Handler, routeMw ...Middleware) {
 	fullPath := utils.JoinPaths(c.prefix, path)
+	for i := len(routeMw) - 1; i >= 0; i-- {
+		handler = routeMw[i].Apply(handler)
+	}
 	wrappedHandler := c.applyMiddleware(handler)
-	c.router.Register(method, fullPath, wrappedHandler)
+
+	var names []string
+	for _, mw := range slices.Concat(c.collectMiddleware(), routeMw) {
+		names = append(names, mw.Name)
+	}
+	c.router.register(method, fullPath, wrappedHandler, names)
+}
+func (c *Cluster) Get(path string, handler Handler, mw ...Middleware) {
+	c.registerRoute("GET", path, handler, mw...)
+}
+func (c *Cluster) Post(path string, handler Handler, mw ...Middleware) {
+	c.registerRoute("POST", path, handler, mw...)
 }
-func (c *Cluster) Get(path string, handler Handler)  { c.registerRoute("GET", path, handler) }
-func (c *Cluster) Post(path string, handler Handler) { c.registerRoute("POST", path, handler) }
-func (c *Cluster) Put(path string, handler Handler) {
-	c.registerRoute("PUT", path, handler)
+func (c *Cluster) Put(path string, handler Handler, mw ...Middleware) {
+	c.registerRoute("PUT", path, handler, mw...)
 }
 
-func (c *Cluster) Patch(path string, handler Handler) {
-	c.registerRoute("PATCH", path, handler)
+func (c *Cluster) Patch(path string, handler Handler, mw ...Middleware) {
+	c.registerRoute("PATCH", path, handler, mw...)
 }
 
-func (c *Cluster) Delete(path string, handler Handler) {
-	c.registerRoute("DELETE", path, handler)
+func (c *Cluster) Delete(path string, handler Handler, mw ...Middleware) {
+	c.registerRoute("DELETE", path, handler, mw...)
 }
 
-func (c *Cluster) Head(path string, handler Handler) {
-	c.registerRoute("HEAD", path, handler)
+func (c *Cluster) Head(path string, handler Handler, mw ...Middleware) {
+	c.registerRoute("HEAD", path, handler, mw...)
 }
 
-func (c *Cluster) Options(path string, handler Handler) {
-	c.registerRoute("OPTIONS", path, handler)
+func (c *Cluster) Options(path string, handler Handler, mw ...Middleware) {
+	c.registerRoute("OPTIONS", path, handler, mw...)
 }
 
-func (c *Cluster) Trace(path string, handler Handler) {
-	c.registerRoute("TRACE", path, handler)
+func (c *Cluster) Trace(path string, handler Handler, mw ...Middleware) {
+	c.registerRoute("TRACE", path, handler, mw...)
 }
@@ -25,10 +25,11 @@ var (
 )
 
 type App struct {
-	router  *Router
-	config  *Config
-	server  *fasthttp.Server
-	options []Option
+	router        *Router
+	config        *Config
+	server        *fasthttp.Server
+	options       []Option
+	shutdownHooks []func()
 }
 
 type Config struct {
@@ -41,6 +42,9 @@ type Config struct {
 	ReduceMemoryUsage  bool
 	DisableKeepalive   bool
 	CloseOnShutdown    bool
+	StreamRequestBody  bool
+	ErrorHandler       ErrorHandler
+	Templates          *TemplateEngine
 }
 
 type Option func(*Config)
@@ -77,14 +81,34 @@ func WithMaxRequestBodySize(size int) Option {
 	return func(c *Config) { c.MaxRequestBodySize = size }
 }
 
+// WithStreamRequestBody streams request bodies instead of buffering them,
+// letting upload helpers read bodies larger than MaxRequestBodySize
+func WithStreamRequestBody(enabled bool) Option {
+	return func(c *Config) { c.StreamRequestBody = enabled }
+}
+
+// WithErrorHandler replaces the default JSON error response for errors returned by handlers
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(c *Config) { c.ErrorHandler = handler }
+}
+
+// WithTemplates sets the engine used by Context.Render
+func WithTemplates(engine *TemplateEngine) Option {
+	return func(c *Config) { c.Templates = engine }
+}
+
 func New(opts ...Option) *App {
 	config := defaultConfig()
 	for _, opt := range opts {
 		opt(config)
 	}
 
+	router := NewRouter()
+	router.SetErrorHandler(config.ErrorHandler)
+	router.SetTemplates(config.Templates)
+
 	return &App{
-		router:  NewRouter(),
+		router:  router,
 		config:  config,
 		options: opts,
 	}
@@ -94,6 +118,12 @@ func (a *App) ApplyMiddleware(mw ...Middleware) *App {
 	return a
 }
 
+// OnShutdown registers fn to run after the server has stopped accepting requests
+func (a *App) OnShutdown(fn func()) *App {
+	a.shutdownHooks = append(a.shutdownHooks, fn)
+	return a
+}
+
 func (a *App) Cluster(prefix string, block func(*Cluster)) *App {
 	cluster := NewCluster(prefix, a.router)
 	block(cluster)
@@ -106,10 +136,15 @@ func (a *App) Mount(cluster *Cluster) *App {
 	return a
 }
 
+// Routes lists the registered routes, see Router.Routes
+func (a *App) Routes() []RouteInfo {
+	return a.router.Routes()
+}
+
 // traverseAndRegister recursively registers all routes from the source router into the target router
 func traverseAndRegister(targetRouter *Router, method, currentPath string, node *routeNode) {
 	if node.handler != nil {
-		targetRouter.Register(method, currentPath, node.handler)
+		targetRouter.register(method, currentPath, node.handler, node.middleware)
 	}
 
 	for segment, childNode := range node.children {
@@ -154,6 +189,7 @@ func (a *App) Start(addr string) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	a.router.baseCtx = ctx
 
 	a.server = &fasthttp.Server{
 		Name:                  CLOSURE,
@@ -167,6 +203,7 @@ func (a *App) Start(addr string) {
 		ReduceMemoryUsage:     a.config.ReduceMemoryUsage,
 		DisableKeepalive:      a.config.DisableKeepalive,
 		CloseOnShutdown:       a.config.CloseOnShutdown,
+		StreamRequestBody:     a.config.StreamRequestBody,
 		NoDefaultServerHeader: true,
 		NoDefaultDate:         true,
 		NoDefaultContentType:  true,
@@ -176,7 +213,7 @@ func (a *App) Start(addr string) {
 	go func() {
 		err := a.server.ListenAndServe(addr)
 		if err != nil {
-			logging.Error(err.Error())
+			logging.Error("%s", err.Error())
 			serverError <- err
 		}
 	}()
@@ -192,8 +229,17 @@ func (a *App) Start(addr string) {
 	logging.Info("Shutting down the server .....")
 	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 2*time.Second)
 	defer shutdownCancel()
+	// In-flight requests get the grace period, then their contexts are cancelled
+	context.AfterFunc(shutdownCtx, cancel)
+
+	// Upgrades arriving while the server drains are refused from here on
+	a.router.websockets.closeAll(shutdownCtx)
+	err := a.server.ShutdownWithContext(shutdownCtx)
+	for _, hook := range a.shutdownHooks {
+		hook()
+	}
 
-	if err := a.server.ShutdownWithContext(shutdownCtx); err != nil {
+	if err != nil {
 		logging.Fatal("Error occurred during shutdown %s", err.Error())
 	} else {
 		logging.Fatal("Server is successfully shut down")
@@ -0,0 +1,67 @@
+package closure
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// SetETag sets the ETag response header, quoting value. Weak tags satisfy
+// If-None-Match but never If-Match.
+func (c *Context) SetETag(value string, weak bool) {
+	etag := `"` + value + `"`
+	if weak {
+		etag = "W/" + etag
+	}
+	c.Response.Header.Set("ETag", etag)
+}
+
+// SetLastModified sets the Last-Modified response header
+func (c *Context) SetLastModified(modTime time.Time) {
+	c.Response.Header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+}
+
+// NotModified responds 304. Unlike the fasthttp method it shadows, the response
+// headers are kept so the client still gets ETag, Last-Modified and Cache-Control.
+func (c *Context) NotModified() {
+	c.Response.ResetBody()
+	c.SetStatusCode(fasthttp.StatusNotModified)
+}
+
+// CheckPreconditions evaluates the conditional request headers against the current
+// etag and modification time of the resource, either of which may be empty.
+// It responds 304 or 412 and returns false when the handler should stop.
+func (c *Context) CheckPreconditions(etag string, modTime time.Time) bool {
+	if ifMatch := string(c.Request.Header.Peek("If-Match")); ifMatch != "" {
+		// A missing resource matches nothing, not even "*"
+		if etag == "" || !etagListMatches(ifMatch, etag, false) {
+			JSONError(c, fasthttp.StatusPreconditionFailed, "Precondition Failed")
+			return false
+		}
+	} else if ius := c.Request.Header.Peek("If-Unmodified-Since"); len(ius) > 0 && !modTime.IsZero() {
+		if since, err := http.ParseTime(string(ius)); err == nil && modTime.Truncate(time.Second).After(since) {
+			JSONError(c, fasthttp.StatusPreconditionFailed, "Precondition Failed")
+			return false
+		}
+	}
+
+	safe := c.IsGet() || c.IsHead()
+	if ifNoneMatch := string(c.Request.Header.Peek("If-None-Match")); ifNoneMatch != "" {
+		if etag == "" || !etagListMatches(ifNoneMatch, etag, true) {
+			return true
+		}
+		if safe {
+			c.NotModified()
+		} else {
+			JSONError(c, fasthttp.StatusPreconditionFailed, "Precondition Failed")
+		}
+		return false
+	}
+
+	if safe && notModified(c, etag, modTime) {
+		c.NotModified()
+		return false
+	}
+	return true
+}
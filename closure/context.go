@@ -0,0 +1,87 @@
+package closure
+
+import (
+	"context"
+	"maps"
+
+	"github.com/valyala/fasthttp"
+)
+
+// requestContext resolves values from the fasthttp user values before
+// falling back to the parent context
+type requestContext struct {
+	context.Context
+	rc *fasthttp.RequestCtx
+}
+
+func (r *requestContext) Value(key any) any {
+	if value := r.rc.UserValue(key); value != nil {
+		return value
+	}
+	return r.Context.Value(key)
+}
+
+// Context returns a context.Context scoped to this request. It carries the
+// values set through SetUserValue and is cancelled when the client disconnects,
+// the handler returns, the route timeout passes or the App shuts down.
+// Disconnects are noticed on unix platforms while the handler chain runs, but
+// not for streamed request bodies, and not once a pipelined request is waiting.
+func (c *Context) Context() context.Context {
+	if c.ctx == nil {
+		ctx, cancel := context.WithCancel(c.ServerContext())
+		c.ctx = &requestContext{Context: ctx, rc: c.RequestCtx}
+		c.OnDone(cancel)
+		c.watchClient(cancel)
+	}
+	return c.ctx
+}
+
+// watchClient cancels the request context when the client goes away. A streamed
+// request body is read from the connection by the handler, so it is not watched.
+func (c *Context) watchClient(cancel func()) {
+	if c.Conn() == nil || c.Request.IsBodyStream() {
+		return
+	}
+	c.cleanupMu.Lock()
+	defer c.cleanupMu.Unlock()
+	if c.returned {
+		return
+	}
+	c.stopWatch = watchConn(c.Conn(), cancel)
+}
+
+// ServerContext returns a context cancelled when the App shuts down. Background
+// work started by middleware, such as sweepers, should stop once it is done.
+func (c *Context) ServerContext() context.Context {
+	if c.router != nil && c.router.baseCtx != nil {
+		return c.router.baseCtx
+	}
+	return context.Background()
+}
+
+// Route returns the pattern of the matched route, e.g. "/users/:id", or "" outside the router
+func (c *Context) Route() string {
+	return c.route
+}
+
+// SetContext replaces the request context, e.g. to attach a deadline or values.
+// The new context should be derived from Context().
+func (c *Context) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// Detach copies the request into a new Context that is not tied to the client
+// connection, so a handler can run again in the background, e.g. to refresh a
+// cached response. Locals are not copied. Call the returned function when done.
+func (c *Context) Detach() (*Context, func()) {
+	rc := new(fasthttp.RequestCtx)
+	rc.Init(&c.Request, c.RemoteAddr(), nil)
+
+	detached := acquireContext(rc, c.router)
+	detached.Params = maps.Clone(c.Params)
+	detached.route = c.route
+	return detached, func() {
+		detached.release()
+		releaseContext(detached)
+	}
+}
@@ -0,0 +1,245 @@
+package closure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// SameSite modes for cookies
+const (
+	SameSiteLax    = fasthttp.CookieSameSiteLaxMode
+	SameSiteStrict = fasthttp.CookieSameSiteStrictMode
+	SameSiteNone   = fasthttp.CookieSameSiteNoneMode
+)
+
+// minCookieKeyLen is the shortest secret accepted for signing and encrypting cookies
+const minCookieKeyLen = 32
+
+var (
+	ErrCookieNotFound = errors.New("cookie not found")
+	ErrInvalidCookie  = errors.New("cookie signature or encryption is invalid")
+	ErrCookieKeyShort = errors.New("cookie keys must be at least 32 bytes")
+)
+
+// CookieOption customizes a cookie set on the response
+type CookieOption func(*fasthttp.Cookie)
+
+func WithCookiePath(path string) CookieOption {
+	return func(c *fasthttp.Cookie) { c.SetPath(path) }
+}
+
+func WithCookieDomain(domain string) CookieOption {
+	return func(c *fasthttp.Cookie) { c.SetDomain(domain) }
+}
+
+// WithCookieMaxAge sets how long the cookie lives, a negative duration deletes it
+func WithCookieMaxAge(d time.Duration) CookieOption {
+	return func(c *fasthttp.Cookie) {
+		if d < 0 {
+			c.SetMaxAge(-1)
+			return
+		}
+		c.SetMaxAge(int(d.Seconds()))
+	}
+}
+
+func WithCookieExpires(t time.Time) CookieOption {
+	return func(c *fasthttp.Cookie) { c.SetExpire(t) }
+}
+
+func WithCookieSameSite(mode fasthttp.CookieSameSite) CookieOption {
+	return func(c *fasthttp.Cookie) { c.SetSameSite(mode) }
+}
+
+// WithCookieSecure controls the Secure flag, which is on by default
+func WithCookieSecure(secure bool) CookieOption {
+	return func(c *fasthttp.Cookie) { c.SetSecure(secure) }
+}
+
+// WithCookieHTTPOnly controls the HttpOnly flag, which is on by default
+func WithCookieHTTPOnly(httpOnly bool) CookieOption {
+	return func(c *fasthttp.Cookie) { c.SetHTTPOnly(httpOnly) }
+}
+
+// SetCookie sets a response cookie. Cookies default to Path=/, HttpOnly, Secure and SameSite=Lax.
+func (c *Context) SetCookie(name, value string, opts ...CookieOption) {
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+
+	cookie.SetKey(name)
+	cookie.SetValue(value)
+	cookie.SetPath("/")
+	cookie.SetHTTPOnly(true)
+	cookie.SetSecure(true)
+	cookie.SetSameSite(SameSiteLax)
+	for _, opt := range opts {
+		opt(cookie)
+	}
+
+	c.Response.Header.SetCookie(cookie)
+}
+
+// Cookie returns the value of a request cookie
+func (c *Context) Cookie(name string) (string, bool) {
+	value := c.Request.Header.Cookie(name)
+	if value == nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+// DeleteCookie tells the client to drop a cookie. Path and domain options must match the original cookie.
+func (c *Context) DeleteCookie(name string, opts ...CookieOption) {
+	opts = append(opts, WithCookieMaxAge(-1), WithCookieExpires(fasthttp.CookieExpireDelete))
+	c.SetCookie(name, "", opts...)
+}
+
+// CookieKeys signs and encrypts cookie values. The first key is used for new
+// cookies while every key is accepted when reading, which allows key rotation.
+type CookieKeys struct {
+	signing    [][]byte
+	encryption []cipher.AEAD
+}
+
+// NewCookieKeys creates a key ring from secrets of at least 32 bytes, newest first
+func NewCookieKeys(secrets ...[]byte) (*CookieKeys, error) {
+	if len(secrets) == 0 {
+		return nil, ErrCookieKeyShort
+	}
+
+	keys := &CookieKeys{}
+	for _, secret := range secrets {
+		if len(secret) < minCookieKeyLen {
+			return nil, ErrCookieKeyShort
+		}
+
+		keys.signing = append(keys.signing, deriveKey(secret, "closure cookie signing"))
+
+		block, err := aes.NewCipher(deriveKey(secret, "closure cookie encryption"))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys.encryption = append(keys.encryption, aead)
+	}
+	return keys, nil
+}
+
+// Sign returns value with an HMAC bound to the cookie name
+func (k *CookieKeys) Sign(name, value string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+	mac := cookieMAC(k.signing[0], name, encoded)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac)
+}
+
+// Verify checks a signed value against every key and returns the original value
+func (k *CookieKeys) Verify(name, signed string) (string, error) {
+	encoded, sig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", ErrInvalidCookie
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", ErrInvalidCookie
+	}
+
+	for _, key := range k.signing {
+		if hmac.Equal(mac, cookieMAC(key, name, encoded)) {
+			value, err := base64.RawURLEncoding.DecodeString(encoded)
+			if err != nil {
+				return "", ErrInvalidCookie
+			}
+			return string(value), nil
+		}
+	}
+	return "", ErrInvalidCookie
+}
+
+// Encrypt seals value with AES-GCM, using the cookie name as associated data
+func (k *CookieKeys) Encrypt(name, value string) (string, error) {
+	aead := k.encryption[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens an encrypted value with any of the keys
+func (k *CookieKeys) Decrypt(name, encrypted string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", ErrInvalidCookie
+	}
+
+	for _, aead := range k.encryption {
+		if len(sealed) < aead.NonceSize() {
+			return "", ErrInvalidCookie
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if plain, err := aead.Open(nil, nonce, ciphertext, []byte(name)); err == nil {
+			return string(plain), nil
+		}
+	}
+	return "", ErrInvalidCookie
+}
+
+// SetSignedCookie sets a cookie whose value is readable by the client but cannot be tampered with
+func (c *Context) SetSignedCookie(keys *CookieKeys, name, value string, opts ...CookieOption) {
+	c.SetCookie(name, keys.Sign(name, value), opts...)
+}
+
+// SignedCookie returns the value of a signed cookie after verifying it
+func (c *Context) SignedCookie(keys *CookieKeys, name string) (string, error) {
+	raw, ok := c.Cookie(name)
+	if !ok {
+		return "", ErrCookieNotFound
+	}
+	return keys.Verify(name, raw)
+}
+
+// SetEncryptedCookie sets a cookie whose value is hidden from the client
+func (c *Context) SetEncryptedCookie(keys *CookieKeys, name, value string, opts ...CookieOption) error {
+	encrypted, err := keys.Encrypt(name, value)
+	if err != nil {
+		return err
+	}
+	c.SetCookie(name, encrypted, opts...)
+	return nil
+}
+
+// EncryptedCookie returns the decrypted value of an encrypted cookie
+func (c *Context) EncryptedCookie(keys *CookieKeys, name string) (string, error) {
+	raw, ok := c.Cookie(name)
+	if !ok {
+		return "", ErrCookieNotFound
+	}
+	return keys.Decrypt(name, raw)
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func cookieMAC(key []byte, name, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package closure
+
+import "net"
+
+// watchConn is not supported on this platform, the request context is only
+// cancelled once the handler returns
+func watchConn(conn net.Conn, cancel func()) (stop func()) {
+	return func() {}
+}
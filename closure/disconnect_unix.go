@@ -0,0 +1,61 @@
+//go:build unix
+
+package closure
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// watchConn calls cancel once the client closes conn and returns a function
+// that stops watching. The socket is only peeked, so a pipelined request that
+// is already waiting ends the watch without cancelling.
+func watchConn(conn net.Conn, cancel func()) (stop func()) {
+	for {
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return func() {}
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return func() {}
+	}
+
+	var stopped atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1)
+		_ = raw.Read(func(fd uintptr) bool {
+			if stopped.Load() {
+				return true
+			}
+			n, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				return false
+			}
+			if n == 0 || err != nil {
+				cancel()
+			}
+			return true
+		})
+	}()
+
+	return func() {
+		stopped.Store(true)
+		// A deadline in the past wakes the watcher, the server sets its own
+		// deadlines again before it reads the next request
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
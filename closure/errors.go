@@ -0,0 +1,30 @@
+package closure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HTTPError is an error carrying the status code the router should respond with
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+// NewHTTPError creates an HTTPError for the given status code and message
+func NewHTTPError(code int, message string) *HTTPError {
+	return &HTTPError{Code: code, Message: message}
+}
+
+// asHTTPError reports whether err wraps an HTTPError and returns it
+func asHTTPError(err error) (*HTTPError, bool) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr, true
+	}
+	return nil, false
+}
@@ -0,0 +1,87 @@
+package closure
+
+// Key identifies a typed value stored on a Context, so that middleware can hand
+// data to handlers without string keys or type assertions
+type Key[T any] struct {
+	id *keyID
+}
+
+type keyID struct {
+	name string
+}
+
+type localEntry struct {
+	id    *keyID
+	value any
+}
+
+// NewKey creates a key. The name is only used when locals are visited,
+// two keys with the same name never collide.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{id: &keyID{name: name}}
+}
+
+// Name returns the name the key was created with
+func (k Key[T]) Name() string {
+	return k.id.name
+}
+
+// Set stores value under the key for the rest of the request
+func (k Key[T]) Set(c *Context, value T) {
+	for i := range c.locals {
+		if c.locals[i].id == k.id {
+			c.locals[i].value = value
+			return
+		}
+	}
+	c.locals = append(c.locals, localEntry{id: k.id, value: value})
+}
+
+// Get returns the value stored under the key and whether it was set
+func (k Key[T]) Get(c *Context) (T, bool) {
+	for _, entry := range c.locals {
+		if entry.id == k.id {
+			value, ok := entry.value.(T)
+			return value, ok
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// MustGet returns the value stored under the key and panics when it is missing
+func (k Key[T]) MustGet(c *Context) T {
+	value, ok := k.Get(c)
+	if !ok {
+		panic("closure: no value for key " + k.id.name)
+	}
+	return value
+}
+
+// Delete removes the value stored under the key
+func (k Key[T]) Delete(c *Context) {
+	for i := range c.locals {
+		if c.locals[i].id == k.id {
+			c.locals = append(c.locals[:i], c.locals[i+1:]...)
+			return
+		}
+	}
+}
+
+// Set stores value under key on the context
+func Set[T any](c *Context, key Key[T], value T) {
+	key.Set(c, value)
+}
+
+// Get returns the value stored under key on the context
+func Get[T any](c *Context, key Key[T]) (T, bool) {
+	return key.Get(c)
+}
+
+// VisitLocals calls visitor for every typed value stored on the context,
+// letting loggers and error handlers enrich their output
+func (c *Context) VisitLocals(visitor func(name string, value any)) {
+	for _, entry := range c.locals {
+		visitor(entry.id.name, entry.value)
+	}
+}
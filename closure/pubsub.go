@@ -0,0 +1,334 @@
+package closure
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// SlowConsumerPolicy decides what happens when a subscriber's send buffer is full
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest discards the message being published for that subscriber
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest discards the oldest buffered message to make room
+	DropOldest
+	// Disconnect closes the subscriber along with the WebSocket it forwards to
+	Disconnect
+)
+
+// ErrHubClosed is returned when subscribing to a hub that has been closed
+var ErrHubClosed = errors.New("hub closed")
+
+// Message is a payload published to a topic
+type Message struct {
+	Topic string `json:"topic"`
+	Data  any    `json:"data"`
+}
+
+// HubConfig tunes a Hub. Zero values fall back to the defaults.
+type HubConfig struct {
+	// BufferSize is the number of messages buffered per subscriber
+	BufferSize int
+	Policy     SlowConsumerPolicy
+}
+
+// HubMetrics is a snapshot of hub activity
+type HubMetrics struct {
+	Topics      int    `json:"topics"`
+	Subscribers int    `json:"subscribers"`
+	Published   uint64 `json:"published"`
+	Delivered   uint64 `json:"delivered"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+// Hub fans out published messages to the subscribers of a topic
+type Hub struct {
+	config HubConfig
+
+	mu          sync.RWMutex
+	topics      map[string]map[*Subscriber]struct{}
+	subscribers map[*Subscriber]struct{}
+	closed      bool
+
+	published atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// NewHub creates an in-process pub/sub hub
+func NewHub(config ...HubConfig) *Hub {
+	var cfg HubConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 64
+	}
+
+	return &Hub{
+		config:      cfg,
+		topics:      make(map[string]map[*Subscriber]struct{}),
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+// Hub creates a pub/sub hub that is closed when the App shuts down
+func (a *App) Hub(config ...HubConfig) *Hub {
+	hub := NewHub(config...)
+	a.OnShutdown(hub.Close)
+	return hub
+}
+
+// Subscriber receives messages from the topics it has joined
+type Subscriber struct {
+	hub       *Hub
+	send      chan Message
+	topics    map[string]struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	// closeConn closes the connection the subscriber forwards to when the hub drops
+	// the subscriber, i.e. on shutdown or as a slow consumer
+	closeConn func(code int, reason string)
+}
+
+// Subscribe registers sink to receive messages for topics. Sink is called from a
+// dedicated goroutine, and the subscriber is closed when sink returns an error.
+func (h *Hub) Subscribe(sink func(msg Message) error, topics ...string) (*Subscriber, error) {
+	return h.subscribe(sink, nil, topics)
+}
+
+func (h *Hub) subscribe(sink func(msg Message) error, closeConn func(code int, reason string), topics []string) (*Subscriber, error) {
+	sub := &Subscriber{
+		hub:       h,
+		send:      make(chan Message, h.config.BufferSize),
+		topics:    make(map[string]struct{}),
+		done:      make(chan struct{}),
+		closeConn: closeConn,
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, ErrHubClosed
+	}
+	h.subscribers[sub] = struct{}{}
+	for _, topic := range topics {
+		h.join(sub, topic)
+	}
+	h.mu.Unlock()
+
+	go sub.pump(sink)
+	return sub, nil
+}
+
+// SubscribeWS forwards messages to a WebSocket connection as JSON until it closes
+func (h *Hub) SubscribeWS(conn *WSConn, topics ...string) (*Subscriber, error) {
+	sink := func(msg Message) error {
+		return conn.WriteJSON(msg)
+	}
+	closeConn := func(code int, reason string) {
+		_ = conn.CloseWith(code, reason)
+	}
+
+	sub, err := h.subscribe(sink, closeConn, topics)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-conn.Done():
+			sub.Close()
+		case <-sub.Done():
+		}
+	}()
+	return sub, nil
+}
+
+// SubscribeSSE forwards messages to an event stream, using the topic as the event name
+func (h *Hub) SubscribeSSE(stream *SSEStream, topics ...string) (*Subscriber, error) {
+	sub, err := h.Subscribe(func(msg Message) error {
+		return stream.Event(msg.Topic, msg.Data)
+	}, topics...)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-stream.Done():
+			sub.Close()
+		case <-sub.Done():
+		}
+	}()
+	return sub, nil
+}
+
+// Publish sends data to every subscriber of topic and returns how many received it
+func (h *Hub) Publish(topic string, data any) int {
+	msg := Message{Topic: topic, Data: data}
+	h.published.Add(1)
+
+	h.mu.RLock()
+	subs := make([]*Subscriber, 0, len(h.topics[topic]))
+	for sub := range h.topics[topic] {
+		subs = append(subs, sub)
+	}
+	h.mu.RUnlock()
+
+	delivered := 0
+	for _, sub := range subs {
+		if sub.deliver(msg, h.config.Policy) {
+			delivered++
+		}
+	}
+	h.delivered.Add(uint64(delivered))
+	return delivered
+}
+
+// Subscribers returns the number of subscribers of topic
+func (h *Hub) Subscribers(topic string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.topics[topic])
+}
+
+// Metrics returns the current topic and subscriber counts along with message counters
+func (h *Hub) Metrics() HubMetrics {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return HubMetrics{
+		Topics:      len(h.topics),
+		Subscribers: len(h.subscribers),
+		Published:   h.published.Load(),
+		Delivered:   h.delivered.Load(),
+		Dropped:     h.dropped.Load(),
+	}
+}
+
+// Close closes every subscriber along with its connection and rejects new ones
+func (h *Hub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	subs := make([]*Subscriber, 0, len(h.subscribers))
+	for sub := range h.subscribers {
+		subs = append(subs, sub)
+	}
+	h.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+		if sub.closeConn != nil {
+			sub.closeConn(CloseGoingAway, "server shutting down")
+		}
+	}
+}
+
+// join must be called with h.mu held
+func (h *Hub) join(sub *Subscriber, topic string) {
+	if h.topics[topic] == nil {
+		h.topics[topic] = make(map[*Subscriber]struct{})
+	}
+	h.topics[topic][sub] = struct{}{}
+	sub.topics[topic] = struct{}{}
+}
+
+// leave must be called with h.mu held
+func (h *Hub) leave(sub *Subscriber, topic string) {
+	delete(h.topics[topic], sub)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+	delete(sub.topics, topic)
+}
+
+// Join adds the subscriber to topic
+func (s *Subscriber) Join(topic string) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if _, ok := s.hub.subscribers[s]; ok {
+		s.hub.join(s, topic)
+	}
+}
+
+// Leave removes the subscriber from topic
+func (s *Subscriber) Leave(topic string) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.leave(s, topic)
+}
+
+// Done is closed once the subscriber has been closed
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close unsubscribes from every topic and stops delivery
+func (s *Subscriber) Close() {
+	s.closeOnce.Do(func() {
+		s.hub.mu.Lock()
+		for topic := range s.topics {
+			s.hub.leave(s, topic)
+		}
+		delete(s.hub.subscribers, s)
+		s.hub.mu.Unlock()
+
+		close(s.done)
+	})
+}
+
+// deliver queues msg without blocking the publisher, applying the slow consumer policy
+func (s *Subscriber) deliver(msg Message, policy SlowConsumerPolicy) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	select {
+	case s.send <- msg:
+		return true
+	default:
+	}
+
+	switch policy {
+	case DropOldest:
+		select {
+		case <-s.send:
+			s.hub.dropped.Add(1)
+		default:
+		}
+		select {
+		case s.send <- msg:
+			return true
+		default:
+		}
+	case Disconnect:
+		go func() {
+			s.Close()
+			if s.closeConn != nil {
+				s.closeConn(ClosePolicyViolation, "too slow")
+			}
+		}()
+	}
+	s.hub.dropped.Add(1)
+	return false
+}
+
+// pump hands queued messages to sink until the subscriber closes
+func (s *Subscriber) pump(sink func(msg Message) error) {
+	for {
+		select {
+		case msg := <-s.send:
+			if err := sink(msg); err != nil {
+				s.Close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package closure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ErrNoTemplates is returned by Render when no TemplateEngine has been configured
+var ErrNoTemplates = errors.New("no template engine configured")
+
+// TemplateConfig describes where templates live and how they are composed.
+// Templates are named by their path without extension, e.g. "users/index".
+type TemplateConfig struct {
+	// FS holds the templates, an embed.FS works well for production builds
+	FS fs.FS
+	// Extension of template files, ".html" by default
+	Extension string
+	// LayoutsDir and PartialsDir hold templates shared by every page,
+	// "layouts" and "partials" by default
+	LayoutsDir  string
+	PartialsDir string
+	// DefaultLayout wraps every page unless another layout is requested, e.g. "layouts/main".
+	// A layout renders the page with {{template "content" .}}.
+	DefaultLayout string
+	Funcs         template.FuncMap
+	// DevMode reparses templates on every render so edits show up without a restart.
+	// When DevDir is set templates are read from that directory on disk instead of FS.
+	DevMode bool
+	DevDir  string
+}
+
+// TemplateEngine renders html/template pages with layouts and partials
+type TemplateEngine struct {
+	config TemplateConfig
+
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+}
+
+// NewTemplateEngine compiles every template up front so that errors surface at startup
+func NewTemplateEngine(config TemplateConfig) (*TemplateEngine, error) {
+	if config.Extension == "" {
+		config.Extension = ".html"
+	}
+	if config.LayoutsDir == "" {
+		config.LayoutsDir = "layouts"
+	}
+	if config.PartialsDir == "" {
+		config.PartialsDir = "partials"
+	}
+	if config.FS == nil && config.DevDir == "" {
+		return nil, errors.New("template config needs an FS or a DevDir")
+	}
+
+	engine := &TemplateEngine{config: config}
+	if err := engine.Load(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// Load parses every template again, replacing the compiled set
+func (e *TemplateEngine) Load() error {
+	pages, err := e.compile()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.pages = pages
+	e.mu.Unlock()
+	return nil
+}
+
+// Render executes page name into w. The optional layout overrides DefaultLayout,
+// an empty layout renders the page on its own.
+func (e *TemplateEngine) Render(w io.Writer, name string, data any, layout ...string) error {
+	if e.config.DevMode {
+		if err := e.Load(); err != nil {
+			return err
+		}
+	}
+
+	e.mu.RLock()
+	page, ok := e.pages[name]
+	e.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("template %q not found", name)
+	}
+
+	layoutName := e.config.DefaultLayout
+	if len(layout) > 0 {
+		layoutName = layout[0]
+	}
+	if layoutName == "" {
+		return page.ExecuteTemplate(w, name, data)
+	}
+	return page.ExecuteTemplate(w, layoutName, data)
+}
+
+func (e *TemplateEngine) source() fs.FS {
+	if e.config.DevMode && e.config.DevDir != "" {
+		return os.DirFS(e.config.DevDir)
+	}
+	return e.config.FS
+}
+
+// compile parses the shared layouts and partials once, then clones them for every page
+func (e *TemplateEngine) compile() (map[string]*template.Template, error) {
+	source := e.source()
+	base := template.New("").Funcs(e.config.Funcs)
+	var pageFiles []string
+
+	err := fs.WalkDir(source, ".", func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || path.Ext(file) != e.config.Extension {
+			return nil
+		}
+		if !e.isShared(file) {
+			pageFiles = append(pageFiles, file)
+			return nil
+		}
+		content, err := fs.ReadFile(source, file)
+		if err != nil {
+			return err
+		}
+		_, err = base.New(e.templateName(file)).Parse(string(content))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make(map[string]*template.Template, len(pageFiles))
+	for _, file := range pageFiles {
+		name := e.templateName(file)
+		content, err := fs.ReadFile(source, file)
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := page.New(name).Parse(string(content))
+		if err != nil {
+			return nil, err
+		}
+		// Pages without their own "content" block are used whole as the layout content
+		if !definesContent(name, string(content), e.config.Funcs) {
+			if _, err := page.AddParseTree("content", parsed.Tree); err != nil {
+				return nil, err
+			}
+		}
+		pages[name] = page
+	}
+	return pages, nil
+}
+
+// definesContent reports whether a page defines its own "content" template
+func definesContent(name, content string, funcs template.FuncMap) bool {
+	probe, err := template.New(name).Funcs(funcs).Parse(content)
+	return err == nil && probe.Lookup("content") != nil
+}
+
+func (e *TemplateEngine) isShared(file string) bool {
+	return strings.HasPrefix(file, e.config.LayoutsDir+"/") || strings.HasPrefix(file, e.config.PartialsDir+"/")
+}
+
+func (e *TemplateEngine) templateName(file string) string {
+	return strings.TrimSuffix(file, e.config.Extension)
+}
+
+// Render executes the named template with the router's TemplateEngine and sends it as HTML
+func (c *Context) Render(statusCode int, name string, data any, layout ...string) error {
+	if c.router == nil || c.router.templates == nil {
+		return ErrNoTemplates
+	}
+
+	var buf bytes.Buffer
+	if err := c.router.templates.Render(&buf, name, data, layout...); err != nil {
+		return err
+	}
+
+	c.SetContentType("text/html; charset=utf-8")
+	c.SetStatusCode(statusCode)
+	c.SetBody(buf.Bytes())
+	return nil
+}
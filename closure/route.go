@@ -1,10 +1,11 @@
 package closure
 
 import (
+	"context"
 	"embed"
 	"io/fs"
-	"path"
 	"strings"
+	"sync"
 
 	"github.com/valyala/fasthttp"
 )
@@ -16,6 +17,122 @@ var swaggerUIAssets embed.FS
 type Context struct {
 	*fasthttp.RequestCtx
 	Params map[string]string
+
+	// route is the pattern the request matched, see Route
+	route     string
+	router    *Router
+	ctx       context.Context
+	locals    []localEntry
+	cleanupMu sync.Mutex
+	cleanups  []func()
+	// holds delays the cleanups while work started by the handler is still running, see Hold
+	holds sync.WaitGroup
+	held  bool
+	// stopWatch ends the client disconnect watch once the handler chain has returned
+	stopWatch func()
+	returned  bool
+	// streamWriter is installed after the middleware chain, see SetBodyStreamWriter
+	streamWriter fasthttp.StreamWriter
+	// streamCtx is ended by the installed stream, see StreamContext
+	streamCtx       context.Context
+	streamCancel    context.CancelFunc
+	streamInstalled bool
+}
+
+var contextPool = sync.Pool{
+	New: func() any { return new(Context) },
+}
+
+func acquireContext(rc *fasthttp.RequestCtx, router *Router) *Context {
+	c := contextPool.Get().(*Context)
+	c.RequestCtx = rc
+	c.router = router
+	return c
+}
+
+// releaseContext returns c to the pool unless a timed out handler may still be using it
+func releaseContext(c *Context) {
+	if c.LastTimeoutErrorResponse() != nil || c.held {
+		return
+	}
+	clear(c.locals)
+	c.locals = c.locals[:0]
+	c.RequestCtx = nil
+	c.Params = nil
+	c.route = ""
+	c.router = nil
+	c.ctx = nil
+	c.streamWriter = nil
+	c.streamCtx = nil
+	c.streamCancel = nil
+	c.streamInstalled = false
+	c.stopWatch = nil
+	c.returned = false
+	contextPool.Put(c)
+}
+
+// OnDone registers fn to run once the handler chain has returned
+func (c *Context) OnDone(fn func()) {
+	c.cleanupMu.Lock()
+	defer c.cleanupMu.Unlock()
+	c.cleanups = append(c.cleanups, fn)
+}
+
+// websockets returns the connection registry of the router serving this request
+func (c *Context) websockets() *wsRegistry {
+	if c.router == nil {
+		return newWSRegistry()
+	}
+	return c.router.websockets
+}
+
+// Hold delays the OnDone cleanups until the returned function is called, for
+// work that outlives the handler chain, e.g. a handler that timed out but is
+// still running. A held Context is not reused for other requests.
+func (c *Context) Hold() func() {
+	c.cleanupMu.Lock()
+	defer c.cleanupMu.Unlock()
+	c.held = true
+	c.holds.Add(1)
+	var once sync.Once
+	return func() { once.Do(c.holds.Done) }
+}
+
+// release runs the registered cleanup functions in reverse order, in the
+// background once every Hold has ended if the Context is held
+func (c *Context) release() {
+	c.cleanupMu.Lock()
+	cleanups := c.cleanups
+	c.cleanups = nil
+	held := c.held
+	c.cleanupMu.Unlock()
+
+	run := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	if held {
+		go func() {
+			c.holds.Wait()
+			run()
+		}()
+		return
+	}
+	run()
+}
+
+// stopWatching ends the client disconnect watch started by Context
+func (c *Context) stopWatching() {
+	c.cleanupMu.Lock()
+	stop := c.stopWatch
+	c.stopWatch = nil
+	c.returned = true
+	c.cleanupMu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
 }
 
 // Handler defines the request handler function signature
@@ -25,6 +142,8 @@ type Handler func(ctx *Context) error
 type routeNode struct {
 	segment    string
 	handler    Handler
+	pattern    string
+	middleware []string
 	children   map[string]*routeNode
 	paramChild *routeNode
 	wildcard   *routeNode
@@ -32,28 +151,61 @@ type routeNode struct {
 
 // Router manages HTTP routes using a trie structure
 type Router struct {
-	methods map[string]*routeNode
+	methods    map[string]*routeNode
+	websockets *wsRegistry
+	// baseCtx is the parent of every request context, cancelled on shutdown
+	baseCtx      context.Context
+	errorHandler ErrorHandler
+	templates    *TemplateEngine
+}
+
+// ErrorHandler turns an error returned by a handler into a response
+type ErrorHandler func(ctx *Context, err error)
+
+// DefaultErrorHandler responds with the status of an HTTPError, or 500 for any other error
+func DefaultErrorHandler(ctx *Context, err error) {
+	if httpErr, ok := asHTTPError(err); ok {
+		JSONError(ctx, httpErr.Code, httpErr.Message)
+		return
+	}
+	JSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+}
+
+// SetTemplates sets the engine used by Context.Render
+func (r *Router) SetTemplates(engine *TemplateEngine) {
+	r.templates = engine
+}
+
+// SetErrorHandler replaces the handler used for errors returned by routes
+func (r *Router) SetErrorHandler(handler ErrorHandler) {
+	r.errorHandler = handler
 }
 
 // NewRouter initializes a new Router instance with Swagger routes
 func NewRouter() *Router {
 	r := &Router{
-		methods: make(map[string]*routeNode),
+		methods:    make(map[string]*routeNode),
+		websockets: newWSRegistry(),
 	}
 
 	r.Register("GET", "/swagger.json", r.serveSwaggerSpec)
-	r.Register("GET", "/docs/", r.serveSwaggerUI)
-	r.Register("GET", "/docs/*filepath", r.serveSwaggerUI)
-	r.Register("GET", "/docs", func(ctx *Context) error {
-		ctx.Redirect("/docs/", fasthttp.StatusMovedPermanently)
-		return nil
-	})
+
+	// Requests for /docs are redirected to /docs/ by the static handler
+	swaggerUI, _ := fs.Sub(swaggerUIAssets, "swagger-ui")
+	serveSwaggerUI := newStaticHandler(swaggerUI, StaticConfig{})
+	r.Register("GET", "/docs", serveSwaggerUI)
+	r.Register("GET", "/docs/*", serveSwaggerUI)
 
 	return r
 }
 
 // Register adds a new route and its handler to the router
 func (r *Router) Register(method, path string, handler Handler) {
+	r.register(method, path, handler, nil)
+}
+
+// register adds a route, recording the names of the middleware wrapped into handler
+func (r *Router) register(method, path string, handler Handler, middleware []string) {
 	method = strings.ToUpper(method)
 	if r.methods[method] == nil {
 		r.methods[method] = &routeNode{children: make(map[string]*routeNode)}
@@ -82,13 +234,14 @@ func (r *Router) Register(method, path string, handler Handler) {
 	}
 
 	current.handler = handler
+	current.pattern = "/" + strings.Join(parts, "/")
+	current.middleware = middleware
 }
 
 func (r *Router) ServeHTTP(ctx *fasthttp.RequestCtx) {
-	ctxON := &Context{
-		RequestCtx: ctx,
-	}
+	ctxON := acquireContext(ctx, r)
 	r.serveHTTPHandleFunc(ctxON)
+	releaseContext(ctxON)
 }
 
 // ServeHTTPHandleFunc processes an HTTP request using tree-based route matching
@@ -103,45 +256,64 @@ func (r *Router) serveHTTPHandleFunc(ctx *Context) {
 	}
 
 	params := make(map[string]string)
-	handler, found := r.matchRoute(root, splitPath(path), params)
+	node := r.matchRoute(root, splitPath(path), params)
 
-	if !found {
+	if node == nil {
 		JSONError(ctx, fasthttp.StatusNotFound, "Not Found")
 		return
 	}
 
-	customCtx := &Context{RequestCtx: ctx.RequestCtx, Params: params}
-	if err := handler(customCtx); err != nil {
-		JSONError(ctx, fasthttp.StatusInternalServerError, err.Error())
+	ctx.Params = params
+	ctx.route = node.pattern
+	defer ctx.release()
+	defer ctx.stopWatching()
+	err := node.handler(ctx)
+	if ctx.LastTimeoutErrorResponse() != nil {
+		// A handler that timed out may still be writing the response
+		return
 	}
+	if err != nil {
+		// The error response replaces any body the handler started to stream
+		ctx.streamWriter = nil
+		if r.errorHandler != nil {
+			r.errorHandler(ctx, err)
+			return
+		}
+		DefaultErrorHandler(ctx, err)
+		return
+	}
+	ctx.installBodyStream()
 }
 
-// matchRoute recursively traverses the trie to find a matching handler
-func (r *Router) matchRoute(node *routeNode, parts []string, params map[string]string) (Handler, bool) {
+// matchRoute recursively traverses the trie to find the node with a matching handler
+func (r *Router) matchRoute(node *routeNode, parts []string, params map[string]string) *routeNode {
 	if len(parts) == 0 {
-		return node.handler, node.handler != nil
+		if node.handler != nil {
+			return node
+		}
+		return nil
 	}
 
 	part := parts[0]
 	if child, exists := node.children[part]; exists {
-		if handler, found := r.matchRoute(child, parts[1:], params); found {
-			return handler, true
+		if found := r.matchRoute(child, parts[1:], params); found != nil {
+			return found
 		}
 	}
 
 	if node.paramChild != nil {
 		params[node.paramChild.segment[1:]] = part
-		if handler, found := r.matchRoute(node.paramChild, parts[1:], params); found {
-			return handler, true
+		if found := r.matchRoute(node.paramChild, parts[1:], params); found != nil {
+			return found
 		}
 	}
 
-	if node.wildcard != nil {
+	if node.wildcard != nil && node.wildcard.handler != nil {
 		params["wildcard"] = strings.Join(parts, "/")
-		return node.wildcard.handler, node.wildcard.handler != nil
+		return node.wildcard
 	}
 
-	return nil, false
+	return nil
 }
 
 // JSONError sends a JSON error response
@@ -173,49 +345,3 @@ func (r *Router) serveSwaggerSpec(ctx *Context) error {
 	ctx.Write(content)
 	return nil
 }
-
-// ServeSwaggerUI serves the Swagger UI files
-func (r *Router) serveSwaggerUI(ctx *Context) error {
-	filepathVal := ctx.UserValue("filepath")
-	filepath, ok := filepathVal.(string)
-	if !ok {
-		JSONError(ctx, fasthttp.StatusBadRequest, "Invalid path parameter")
-		return nil
-	}
-
-	if filepath == "" || filepath == "/" {
-		filepath = "index.html"
-	}
-	filepath = strings.TrimPrefix(filepath, "/")
-
-	if strings.Contains(filepath, "..") {
-		JSONError(ctx, fasthttp.StatusBadRequest, "Invalid path")
-		return nil
-	}
-
-	fullPath := path.Join("swagger-ui", filepath)
-	content, err := swaggerUIAssets.ReadFile(fullPath)
-	if err != nil {
-		ctx.NotFound()
-		return nil
-	}
-
-	switch ext := path.Ext(filepath); ext {
-	case ".js":
-		ctx.SetContentType("application/javascript")
-	case ".css":
-		ctx.SetContentType("text/css")
-	case ".html":
-		ctx.SetContentType("text/html")
-	case ".png":
-		ctx.SetContentType("image/png")
-	default:
-		ctx.SetContentType("text/plain")
-	}
-
-	_, err = ctx.Write(content)
-	if err != nil {
-		return err
-	}
-	return nil
-}
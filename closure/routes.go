@@ -0,0 +1,47 @@
+package closure
+
+import (
+	"cmp"
+	"slices"
+)
+
+// RouteInfo describes a registered route
+type RouteInfo struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Middleware names the middleware wrapping the handler, outermost first
+	Middleware []string `json:"middleware"`
+}
+
+// Routes lists the registered routes sorted by path and method, e.g. to audit
+// which endpoints are protected by which guards
+func (r *Router) Routes() []RouteInfo {
+	var routes []RouteInfo
+	for method, root := range r.methods {
+		routes = collectRoutes(routes, method, root)
+	}
+	slices.SortFunc(routes, func(a, b RouteInfo) int {
+		return cmp.Or(cmp.Compare(a.Path, b.Path), cmp.Compare(a.Method, b.Method))
+	})
+	return routes
+}
+
+func collectRoutes(routes []RouteInfo, method string, node *routeNode) []RouteInfo {
+	if node.handler != nil {
+		routes = append(routes, RouteInfo{
+			Method:     method,
+			Path:       node.pattern,
+			Middleware: slices.Clone(node.middleware),
+		})
+	}
+	for _, child := range node.children {
+		routes = collectRoutes(routes, method, child)
+	}
+	if node.paramChild != nil {
+		routes = collectRoutes(routes, method, node.paramChild)
+	}
+	if node.wildcard != nil {
+		routes = collectRoutes(routes, method, node.wildcard)
+	}
+	return routes
+}
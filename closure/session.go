@@ -0,0 +1,188 @@
+package closure
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// SessionKey holds the session loaded by the session middleware
+var SessionKey = NewKey[*Session]("session")
+
+// SessionRecord is the persisted state of a session
+type SessionRecord struct {
+	Values    map[string]any   `json:"values"`
+	Flashes   map[string][]any `json:"flashes,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	LastSeen  time.Time        `json:"last_seen"`
+}
+
+// Session is the server-side state of a client, identified by a cookie
+type Session struct {
+	id          string
+	previousID  string
+	record      *SessionRecord
+	isNew       bool
+	changed     bool
+	regenerated bool
+	destroyed   bool
+}
+
+// NewSession starts an empty session with a fresh random id
+func NewSession() (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Session{
+		id:    id,
+		isNew: true,
+		record: &SessionRecord{
+			Values:    make(map[string]any),
+			CreatedAt: now,
+			LastSeen:  now,
+		},
+	}, nil
+}
+
+// LoadedSession wraps a record read from a store
+func LoadedSession(id string, record *SessionRecord) *Session {
+	if record.Values == nil {
+		record.Values = make(map[string]any)
+	}
+	return &Session{id: id, record: record}
+}
+
+// Session returns the session attached by the session middleware, or nil
+func (c *Context) Session() *Session {
+	session, _ := SessionKey.Get(c)
+	return session
+}
+
+func (s *Session) ID() string {
+	return s.id
+}
+
+// PreviousID returns the id the session had before Regenerate was called
+func (s *Session) PreviousID() string {
+	return s.previousID
+}
+
+func (s *Session) Record() *SessionRecord {
+	return s.record
+}
+
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+// Changed reports whether the session must be written back to the store
+func (s *Session) Changed() bool {
+	return s.changed
+}
+
+func (s *Session) Regenerated() bool {
+	return s.regenerated
+}
+
+func (s *Session) Destroyed() bool {
+	return s.destroyed
+}
+
+func (s *Session) Get(key string) (any, bool) {
+	value, ok := s.record.Values[key]
+	return value, ok
+}
+
+func (s *Session) GetString(key string) string {
+	value, _ := s.record.Values[key].(string)
+	return value
+}
+
+func (s *Session) Set(key string, value any) {
+	s.record.Values[key] = value
+	s.changed = true
+}
+
+func (s *Session) Delete(key string) {
+	if _, ok := s.record.Values[key]; ok {
+		delete(s.record.Values, key)
+		s.changed = true
+	}
+}
+
+// Clear removes every value but keeps the session id
+func (s *Session) Clear() {
+	s.record.Values = make(map[string]any)
+	s.record.Flashes = nil
+	s.changed = true
+}
+
+// AddFlash stores a message that is removed the first time it is read
+func (s *Session) AddFlash(category string, message any) {
+	if s.record.Flashes == nil {
+		s.record.Flashes = make(map[string][]any)
+	}
+	s.record.Flashes[category] = append(s.record.Flashes[category], message)
+	s.changed = true
+}
+
+// Flashes returns and removes the flash messages of a category
+func (s *Session) Flashes(category string) []any {
+	messages := s.record.Flashes[category]
+	if len(messages) > 0 {
+		delete(s.record.Flashes, category)
+		s.changed = true
+	}
+	return messages
+}
+
+// Regenerate moves the session to a new id while keeping its values and creation time,
+// so the absolute timeout still counts from login.
+// Call it after login or any privilege change to prevent session fixation.
+func (s *Session) Regenerate() error {
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	if !s.regenerated && !s.isNew {
+		s.previousID = s.id
+	}
+	s.id = id
+	s.regenerated = true
+	s.changed = true
+	return nil
+}
+
+// Destroy removes the session from the store and the client at the end of the request
+func (s *Session) Destroy() {
+	s.destroyed = true
+}
+
+// Touch records activity, extending the idle timeout
+func (s *Session) Touch(now time.Time) {
+	s.record.LastSeen = now
+}
+
+// Expired reports whether the session passed its idle or absolute timeout
+func (s *Session) Expired(now time.Time, idle, absolute time.Duration) bool {
+	if idle > 0 && now.Sub(s.record.LastSeen) > idle {
+		return true
+	}
+	return absolute > 0 && now.Sub(s.record.CreatedAt) > absolute
+}
+
+// String keeps the session id out of logs
+func (s *Session) String() string {
+	return fmt.Sprintf("session(values=%d)", len(s.record.Values))
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,229 @@
+package closure
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// SessionStore persists session records. Load returns nil and no error for unknown or expired ids.
+type SessionStore interface {
+	Load(id string) (*SessionRecord, error)
+	Save(id string, record *SessionRecord, ttl time.Duration) error
+	Delete(id string) error
+}
+
+// storedSession is what the stores keep. Records are kept encoded so that
+// concurrent requests of one session never share maps.
+type storedSession struct {
+	Data    []byte    `json:"data"`
+	Expires time.Time `json:"expires"`
+}
+
+// MemorySessionStore keeps sessions in memory, evicting the least recently used beyond its capacity
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type memorySessionEntry struct {
+	id     string
+	stored storedSession
+}
+
+// NewMemorySessionStore creates an in-memory store holding at most capacity sessions
+func NewMemorySessionStore(capacity int) *MemorySessionStore {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	return &MemorySessionStore{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (m *MemorySessionStore) Load(id string) (*SessionRecord, error) {
+	m.mu.Lock()
+	element, ok := m.entries[id]
+	if !ok {
+		m.mu.Unlock()
+		return nil, nil
+	}
+	entry := element.Value.(*memorySessionEntry)
+	if time.Now().After(entry.stored.Expires) {
+		m.removeElement(element)
+		m.mu.Unlock()
+		return nil, nil
+	}
+	m.order.MoveToFront(element)
+	data := entry.stored.Data
+	m.mu.Unlock()
+
+	return decodeSessionRecord(data)
+}
+
+func (m *MemorySessionStore) Save(id string, record *SessionRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	stored := storedSession{Data: data, Expires: time.Now().Add(ttl)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if element, ok := m.entries[id]; ok {
+		element.Value.(*memorySessionEntry).stored = stored
+		m.order.MoveToFront(element)
+		return nil
+	}
+
+	m.entries[id] = m.order.PushFront(&memorySessionEntry{id: id, stored: stored})
+	for m.order.Len() > m.capacity {
+		m.removeElement(m.order.Back())
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[id]; ok {
+		m.removeElement(element)
+	}
+	return nil
+}
+
+// Len returns the number of sessions held, including expired ones not yet evicted
+func (m *MemorySessionStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+func (m *MemorySessionStore) removeElement(element *list.Element) {
+	m.order.Remove(element)
+	delete(m.entries, element.Value.(*memorySessionEntry).id)
+}
+
+// FileSessionStore keeps one JSON file per session in a directory
+type FileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore creates the directory if needed and returns a store backed by it
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+func (f *FileSessionStore) Load(id string) (*SessionRecord, error) {
+	content, err := os.ReadFile(f.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored storedSession
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, err
+	}
+	if time.Now().After(stored.Expires) {
+		_ = os.Remove(f.path(id))
+		return nil, nil
+	}
+	return decodeSessionRecord(stored.Data)
+}
+
+func (f *FileSessionStore) Save(id string, record *SessionRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(storedSession{Data: data, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that readers never see a partial session
+	tmp, err := os.CreateTemp(f.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(id))
+}
+
+func (f *FileSessionStore) Delete(id string) error {
+	err := os.Remove(f.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Cleanup removes expired session files and returns how many were removed
+func (f *FileSessionStore) Cleanup() (int, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(f.dir, entry.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var stored storedSession
+		if json.Unmarshal(content, &stored) != nil || now.After(stored.Expires) {
+			if os.Remove(path) == nil {
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
+
+// path hashes the id so that client-supplied ids can never escape the directory
+func (f *FileSessionStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func decodeSessionRecord(data []byte) (*SessionRecord, error) {
+	var record SessionRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
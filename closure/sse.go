@@ -0,0 +1,213 @@
+package closure
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// DefaultSSEHeartbeat is how often an idle stream sends a keep-alive comment
+const DefaultSSEHeartbeat = 15 * time.Second
+
+// ErrStreamClosed is returned when writing to a stream whose client has gone away
+var ErrStreamClosed = errors.New("stream closed")
+
+// SSEEvent is a single server-sent event. Data that is not a string or
+// []byte is encoded as JSON.
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  any
+	Retry time.Duration
+}
+
+// SSEStream writes events to a connected EventSource client
+type SSEStream struct {
+	mu          sync.Mutex
+	w           *bufio.Writer
+	lastEventID string
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// LastEventID returns the id the client reported when reconnecting, used to resume a stream
+func (s *SSEStream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the client disconnects or the server shuts down
+func (s *SSEStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes an event and flushes it to the client
+func (s *SSEStream) Send(event SSEEvent) error {
+	var b strings.Builder
+	if event.ID != "" {
+		writeSSEField(&b, "id", event.ID)
+	}
+	if event.Event != "" {
+		writeSSEField(&b, "event", event.Event)
+	}
+	if event.Retry > 0 {
+		writeSSEField(&b, "retry", fmt.Sprint(event.Retry.Milliseconds()))
+	}
+
+	data, err := sseData(event.Data)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(data, "\n") {
+		writeSSEField(&b, "data", line)
+	}
+	b.WriteByte('\n')
+
+	return s.write(b.String())
+}
+
+// Event sends data under the given event name
+func (s *SSEStream) Event(name string, data any) error {
+	return s.Send(SSEEvent{Event: name, Data: data})
+}
+
+// Retry tells the client how long to wait before reconnecting
+func (s *SSEStream) Retry(d time.Duration) error {
+	return s.write(fmt.Sprintf("retry: %d\n\n", d.Milliseconds()))
+}
+
+// Comment writes a comment line, which clients ignore
+func (s *SSEStream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString(": ")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return s.write(b.String())
+}
+
+func (s *SSEStream) write(payload string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return ErrStreamClosed
+	default:
+	}
+
+	if _, err := s.w.WriteString(payload); err != nil {
+		s.closeLocked()
+		return ErrStreamClosed
+	}
+	if err := s.w.Flush(); err != nil {
+		s.closeLocked()
+		return ErrStreamClosed
+	}
+	return nil
+}
+
+// close waits for a write in progress, so that the writer is not used once it returns
+func (s *SSEStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *SSEStream) closeLocked() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// SSE switches the response to a text/event-stream and runs handler while the client is connected.
+// The stream is exempt from the server WriteTimeout and sends heartbeat comments while idle.
+func (c *Context) SSE(handler func(stream *SSEStream) error) error {
+	lastEventID := string(c.Request.Header.Peek("Last-Event-ID"))
+	if lastEventID == "" {
+		lastEventID = string(c.QueryArgs().Peek("lastEventId"))
+	}
+	conn := c.Conn()
+	shutdown := c.RequestCtx.Done()
+
+	c.SetContentType("text/event-stream")
+	c.Response.Header.Set("Cache-Control", "no-cache")
+	c.Response.Header.Set("X-Accel-Buffering", "no")
+
+	c.SetBodyStreamWriter(func(w *bufio.Writer) {
+		clearWriteDeadline(conn)
+
+		stream := &SSEStream{
+			w:           w,
+			lastEventID: lastEventID,
+			done:        make(chan struct{}),
+		}
+
+		var heartbeat sync.WaitGroup
+		heartbeat.Add(1)
+		go func() {
+			defer heartbeat.Done()
+			stream.keepAlive(DefaultSSEHeartbeat, shutdown)
+		}()
+		// The writer is only valid until this function returns
+		defer func() {
+			stream.close()
+			heartbeat.Wait()
+		}()
+
+		// Flushing the headers right away lets the client see the stream open
+		if err := stream.Comment("connected"); err != nil {
+			return
+		}
+		_ = handler(stream)
+	})
+	return nil
+}
+
+// keepAlive sends heartbeat comments so that dead connections are detected
+func (s *SSEStream) keepAlive(interval time.Duration, shutdown <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Comment("heartbeat"); err != nil {
+				return
+			}
+		case <-shutdown:
+			s.close()
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func writeSSEField(b *strings.Builder, name, value string) {
+	b.WriteString(name)
+	b.WriteString(": ")
+	b.WriteString(strings.NewReplacer("\r", "", "\n", "").Replace(value))
+	b.WriteByte('\n')
+}
+
+func sseData(data any) (string, error) {
+	switch v := data.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(encoded), nil
+	}
+}
@@ -0,0 +1,382 @@
+package closure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// StaticConfig tunes Cluster.Static. The zero value serves index.html for
+// directories, hides listings and sends precompressed siblings.
+type StaticConfig struct {
+	// Index is served for directory requests, "index.html" by default
+	Index string
+	// Browse lists directory contents when there is no index file
+	Browse bool
+	// MaxAge sets Cache-Control: public, max-age when positive
+	MaxAge time.Duration
+	// DisablePrecompressed stops serving .br and .gz siblings
+	DisablePrecompressed bool
+}
+
+// Static serves the files of fsys under prefix for GET and HEAD requests
+func (c *Cluster) Static(prefix string, fsys fs.FS, config ...StaticConfig) {
+	var cfg StaticConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	handler := newStaticHandler(fsys, cfg)
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	for _, method := range []string{"GET", "HEAD"} {
+		c.registerRoute(method, prefix, handler)
+		c.registerRoute(method, prefix+"/*", handler)
+	}
+}
+
+type staticHandler struct {
+	fsys   fs.FS
+	config StaticConfig
+	// etags caches content hashes of files without a modification time, such as embed.FS files
+	etags sync.Map
+}
+
+var precompressedEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+func newStaticHandler(fsys fs.FS, config StaticConfig) Handler {
+	if config.Index == "" {
+		config.Index = "index.html"
+	}
+	h := &staticHandler{fsys: fsys, config: config}
+	return h.serve
+}
+
+func (h *staticHandler) serve(ctx *Context) error {
+	name := strings.Trim(path.Clean("/"+ctx.Params["wildcard"]), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		JSONError(ctx, fasthttp.StatusBadRequest, "Invalid path")
+		return nil
+	}
+
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		JSONError(ctx, fasthttp.StatusNotFound, "Not Found")
+		return nil
+	}
+
+	if info.IsDir() {
+		requestPath := string(ctx.Path())
+		if !strings.HasSuffix(requestPath, "/") {
+			ctx.Redirect(requestPath+"/", fasthttp.StatusMovedPermanently)
+			return nil
+		}
+
+		index := path.Join(name, h.config.Index)
+		if indexInfo, err := fs.Stat(h.fsys, index); err == nil && !indexInfo.IsDir() {
+			return h.serveFile(ctx, index, indexInfo)
+		}
+		if h.config.Browse {
+			return h.serveListing(ctx, name)
+		}
+		JSONError(ctx, fasthttp.StatusNotFound, "Not Found")
+		return nil
+	}
+
+	return h.serveFile(ctx, name, info)
+}
+
+func (h *staticHandler) serveFile(ctx *Context, name string, info fs.FileInfo) error {
+	contentType, err := h.contentType(name)
+	if err != nil {
+		return err
+	}
+
+	servedName, encoding := name, ""
+	if !h.config.DisablePrecompressed {
+		servedName, encoding, info = h.precompressed(ctx, name, info)
+	}
+
+	etag, err := h.etag(servedName, info)
+	if err != nil {
+		return err
+	}
+	modTime := info.ModTime()
+
+	ctx.Response.Header.Set("Accept-Ranges", "bytes")
+	ctx.Response.Header.Set("ETag", etag)
+	if !modTime.IsZero() {
+		ctx.Response.Header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if h.config.MaxAge > 0 {
+		ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.config.MaxAge.Seconds())))
+	}
+	if encoding != "" {
+		ctx.Response.Header.Set("Content-Encoding", encoding)
+	}
+
+	if notModified(ctx, etag, modTime) {
+		ctx.NotModified()
+		return nil
+	}
+
+	file, err := h.fsys.Open(servedName)
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	start, length, partial, ok := parseRange(ctx, etag, modTime, size)
+	if !ok {
+		_ = file.Close()
+		ctx.Response.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		JSONError(ctx, fasthttp.StatusRequestedRangeNotSatisfiable, "Range Not Satisfiable")
+		return nil
+	}
+
+	body, err := sectionReader(file, start, length)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	ctx.SetContentType(contentType)
+	if partial {
+		ctx.SetStatusCode(fasthttp.StatusPartialContent)
+		ctx.Response.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	}
+	ctx.SetBodyStream(body, int(length))
+	return nil
+}
+
+// precompressed picks a .br or .gz sibling of name that the client accepts
+func (h *staticHandler) precompressed(ctx *Context, name string, info fs.FileInfo) (string, string, fs.FileInfo) {
+	found := false
+	for _, candidate := range precompressedEncodings {
+		siblingInfo, err := fs.Stat(h.fsys, name+candidate.extension)
+		if err != nil || siblingInfo.IsDir() {
+			continue
+		}
+		found = true
+		if ctx.Request.Header.HasAcceptEncoding(candidate.encoding) {
+			ctx.Response.Header.Add("Vary", "Accept-Encoding")
+			return name + candidate.extension, candidate.encoding, siblingInfo
+		}
+	}
+	if found {
+		ctx.Response.Header.Add("Vary", "Accept-Encoding")
+	}
+	return name, "", info
+}
+
+// contentType resolves the MIME type from the extension, sniffing the content as a fallback
+func (h *staticHandler) contentType(name string) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+
+	file, err := h.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// etag is derived from size and modification time, or from a content hash when
+// the file system does not record modification times
+func (h *staticHandler) etag(name string, info fs.FileInfo) (string, error) {
+	if !info.ModTime().IsZero() {
+		return fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()), nil
+	}
+	if cached, ok := h.etags.Load(name); ok {
+		return cached.(string), nil
+	}
+
+	file, err := h.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	h.etags.Store(name, etag)
+	return etag, nil
+}
+
+func (h *staticHandler) serveListing(ctx *Context, name string) error {
+	entries, err := fs.ReadDir(h.fsys, name)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	requestPath := html.EscapeString(string(ctx.Path()))
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!doctype html>\n<html><head><meta charset=\"utf-8\"><title>Index of %s</title></head><body>\n", requestPath)
+	fmt.Fprintf(&b, "<h1>Index of %s</h1>\n<ul>\n<li><a href=\"../\">../</a></li>\n", requestPath)
+	for _, entry := range entries {
+		entryName := entry.Name()
+		link := url.PathEscape(entryName)
+		if entry.IsDir() {
+			entryName += "/"
+			link += "/"
+		}
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link), html.EscapeString(entryName))
+	}
+	b.WriteString("</ul>\n</body></html>\n")
+
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetBodyString(b.String())
+	return nil
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since
+func notModified(ctx *Context, etag string, modTime time.Time) bool {
+	if inm := ctx.Request.Header.Peek("If-None-Match"); len(inm) > 0 {
+		return etagListMatches(string(inm), etag, true)
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	ims := ctx.Request.Header.Peek("If-Modified-Since")
+	if len(ims) == 0 {
+		return false
+	}
+	since, err := http.ParseTime(string(ims))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// etagListMatches compares etag against a comma separated If-Match/If-None-Match list
+func etagListMatches(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange handles a single byte range. Multiple ranges and stale If-Range
+// validators fall back to the full body. ok is false for unsatisfiable ranges.
+func parseRange(ctx *Context, etag string, modTime time.Time, size int64) (start, length int64, partial, ok bool) {
+	header := string(ctx.Request.Header.Peek("Range"))
+	if header == "" || !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, size, false, true
+	}
+	if ifRange := string(ctx.Request.Header.Peek("If-Range")); ifRange != "" {
+		if date, err := http.ParseTime(ifRange); err == nil {
+			if modTime.IsZero() || modTime.Truncate(time.Second).After(date) {
+				return 0, size, false, true
+			}
+		} else if ifRange != etag || strings.HasPrefix(etag, "W/") {
+			return 0, size, false, true
+		}
+	}
+
+	first, last, found := strings.Cut(strings.TrimPrefix(header, "bytes="), "-")
+	if !found {
+		return 0, size, false, true
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+	switch {
+	case first == "":
+		// Suffix range: the last N bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, size > 0
+	default:
+		from, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || from < 0 || from >= size {
+			return 0, 0, false, false
+		}
+		to := size - 1
+		if last != "" {
+			to, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || to < from {
+				return 0, 0, false, false
+			}
+			if to >= size {
+				to = size - 1
+			}
+		}
+		return from, to - from + 1, true, true
+	}
+}
+
+// sectionReader returns a reader over length bytes of file from start that closes the file when done
+func sectionReader(file fs.File, start, length int64) (io.Reader, error) {
+	if start > 0 {
+		if seeker, ok := file.(io.Seeker); ok {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		} else if _, err := io.CopyN(io.Discard, file, start); err != nil {
+			return nil, err
+		}
+	}
+	return &fileBody{Reader: io.LimitReader(file, length), file: file}, nil
+}
+
+// fileBody closes the underlying file once fasthttp has finished sending it
+type fileBody struct {
+	io.Reader
+	file fs.File
+}
+
+func (f *fileBody) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,285 @@
+package closure
+
+import (
+	"bufio"
+	"context"
+	"iter"
+	"net"
+	"sync"
+	"time"
+
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// streamFlushInterval is the longest encoded elements wait in the buffer before being flushed
+	streamFlushInterval = 200 * time.Millisecond
+	// streamFlushBytes flushes the buffer early once this much output is pending
+	streamFlushBytes = 32 * 1024
+)
+
+// StreamJSON writes items as a JSON array without holding the whole payload in memory.
+// Encoding stops when the client disconnects or the server shuts down. A producer
+// behind items should stop once ctx.StreamContext() is done.
+func StreamJSON[T any](ctx *Context, statusCode int, items iter.Seq[T]) error {
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(statusCode)
+	startStream(ctx, func(enc *streamEncoder) {
+		if !enc.raw("[") {
+			return
+		}
+		first := true
+		for item := range items {
+			if !first && !enc.raw(",") {
+				return
+			}
+			first = false
+			if !enc.encode(item) {
+				return
+			}
+		}
+		enc.raw("]")
+	})
+	return nil
+}
+
+// StreamNDJSON writes items as newline-delimited JSON, one document per line
+func StreamNDJSON[T any](ctx *Context, statusCode int, items iter.Seq[T]) error {
+	ctx.SetContentType("application/x-ndjson")
+	ctx.SetStatusCode(statusCode)
+	startStream(ctx, func(enc *streamEncoder) {
+		for item := range items {
+			if !enc.encode(item) || !enc.raw("\n") {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// FromChan adapts a channel to an iterator so it can be passed to StreamJSON or StreamNDJSON.
+// The iterator ends when the channel is closed, or when ctx.StreamContext() is done even
+// while it waits for the next element. The producer should be given ctx.StreamContext()
+// and stop and close the channel once it is done, until then the rest of the channel is
+// drained in the background so the producer is not left blocked.
+func FromChan[T any](ctx *Context, ch <-chan T) iter.Seq[T] {
+	done := ctx.StreamContext().Done()
+	return func(yield func(T) bool) {
+		for {
+			select {
+			case item, ok := <-ch:
+				if !ok {
+					return
+				}
+				if !yield(item) {
+					go drain(ch)
+					return
+				}
+			case <-done:
+				go drain(ch)
+				return
+			}
+		}
+	}
+}
+
+func drain[T any](ch <-chan T) {
+	for range ch {
+	}
+}
+
+// StreamContext returns a context for producers of a streamed response body, e.g. the
+// sender of a FromChan channel. Unlike Context it outlives the handler: it is cancelled
+// once the client disconnects, the stream has been written or the App shuts down.
+func (c *Context) StreamContext() context.Context {
+	if c.streamCtx == nil {
+		ctx, cancel := context.WithCancel(c.ServerContext())
+		c.streamCtx, c.streamCancel = ctx, cancel
+		c.OnDone(func() {
+			// Without a stream nothing else ends the context
+			if !c.streamInstalled {
+				cancel()
+			}
+		})
+	}
+	return c.streamCtx
+}
+
+// SetBodyStreamWriter streams the response body from sw. Unlike the fasthttp method it
+// shadows, sw is handed to fasthttp once the middleware chain returns, so
+// middleware can still wrap it with WrapBodyStreamWriter.
+func (c *Context) SetBodyStreamWriter(sw fasthttp.StreamWriter) {
+	c.Response.ResetBody()
+	c.Response.Header.SetContentLength(-1)
+	c.streamWriter = sw
+}
+
+// IsBodyStream reports whether the response body is streamed
+func (c *Context) IsBodyStream() bool {
+	return c.streamWriter != nil || c.Response.IsBodyStream()
+}
+
+// WrapBodyStreamWriter replaces the pending stream writer with wrap(sw).
+// It reports false when the handler did not call SetBodyStreamWriter.
+func (c *Context) WrapBodyStreamWriter(wrap func(sw fasthttp.StreamWriter) fasthttp.StreamWriter) bool {
+	if c.streamWriter == nil {
+		return false
+	}
+	c.streamWriter = wrap(c.streamWriter)
+	return true
+}
+
+// installBodyStream hands the pending stream writer to fasthttp. Timed out
+// requests are skipped since their handler may still be running.
+func (c *Context) installBodyStream() {
+	if c.LastTimeoutErrorResponse() != nil {
+		return
+	}
+	if c.streamWriter != nil {
+		c.RequestCtx.SetBodyStreamWriter(c.streamWriter)
+		c.streamWriter = nil
+		c.streamInstalled = true
+	}
+}
+
+// streamEncoder encodes values into a streamed response body. A background
+// ticker flushes pending output so slow producers still reach the client.
+type streamEncoder struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	failed bool
+	// ctx is the StreamContext, cancel ends it once writing fails
+	ctx    context.Context
+	cancel func()
+}
+
+// startStream sets up a body stream writer exempt from the server WriteTimeout
+func startStream(ctx *Context, write func(enc *streamEncoder)) {
+	conn := ctx.Conn()
+	shutdown := ctx.RequestCtx.Done()
+	streamCtx := ctx.StreamContext()
+	cancel := ctx.streamCancel
+	handlerDone := make(chan struct{})
+	ctx.OnDone(func() { close(handlerDone) })
+
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		clearWriteDeadline(conn)
+		defer watchStream(conn, cancel, handlerDone)()
+		enc := &streamEncoder{w: w, ctx: streamCtx, cancel: cancel}
+
+		stop := make(chan struct{})
+		var flusher sync.WaitGroup
+		flusher.Add(1)
+		go func() {
+			defer flusher.Done()
+			enc.flushLoop(shutdown, stop)
+		}()
+		write(enc)
+		// The writer is only valid until this function returns
+		close(stop)
+		flusher.Wait()
+
+		enc.flush()
+	})
+}
+
+func (e *streamEncoder) flushLoop(shutdown <-chan struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(streamFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-shutdown:
+			e.mu.Lock()
+			e.fail()
+			e.mu.Unlock()
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// flush pushes buffered output to the client and records a disconnect
+func (e *streamEncoder) flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.failed && e.w.Flush() != nil {
+		e.fail()
+	}
+}
+
+// fail stops the stream and its producers, e.mu must be held
+func (e *streamEncoder) fail() {
+	e.failed = true
+	e.cancel()
+}
+
+// raw writes s and reports whether streaming should continue
+func (e *streamEncoder) raw(s string) bool {
+	return e.write([]byte(s))
+}
+
+// encode writes v as JSON and reports whether streaming should continue
+func (e *streamEncoder) encode(v any) bool {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		logging.Error("stream encoding failed: %s", err.Error())
+		return false
+	}
+	return e.write(encoded)
+}
+
+func (e *streamEncoder) write(p []byte) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.failed || e.ctx.Err() != nil {
+		return false
+	}
+	if _, err := e.w.Write(p); err != nil {
+		e.fail()
+		return false
+	}
+	if e.w.Buffered() >= streamFlushBytes && e.w.Flush() != nil {
+		e.fail()
+		return false
+	}
+	return true
+}
+
+// watchStream cancels the stream once the client disconnects, even while the producer
+// is idle. It starts after the handler has returned, when the watch of Context has
+// ended, and runs until the returned function is called.
+func watchStream(conn net.Conn, cancel func(), handlerDone <-chan struct{}) (stop func()) {
+	end := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-handlerDone:
+		case <-end:
+			return
+		}
+		stopWatch := watchConn(conn, cancel)
+		<-end
+		stopWatch()
+	}()
+	return func() {
+		close(end)
+		<-stopped
+	}
+}
+
+// clearWriteDeadline lifts the server WriteTimeout for long-lived streamed responses
+func clearWriteDeadline(conn net.Conn) {
+	if conn != nil {
+		_ = conn.SetWriteDeadline(time.Time{})
+	}
+}
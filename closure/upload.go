@@ -0,0 +1,250 @@
+package closure
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+const sniffLen = 512
+
+var (
+	ErrNotMultipart     = NewHTTPError(fasthttp.StatusBadRequest, "request is not multipart/form-data")
+	ErrFileTooLarge     = NewHTTPError(fasthttp.StatusRequestEntityTooLarge, "uploaded file is too large")
+	ErrUploadTooLarge   = NewHTTPError(fasthttp.StatusRequestEntityTooLarge, "upload exceeds the total size limit")
+	ErrTooManyFiles     = NewHTTPError(fasthttp.StatusRequestEntityTooLarge, "too many files in upload")
+	ErrFileTypeRejected = NewHTTPError(fasthttp.StatusUnsupportedMediaType, "uploaded file type is not allowed")
+	ErrFieldTooLarge    = NewHTTPError(fasthttp.StatusRequestEntityTooLarge, "form field is too large")
+)
+
+// defaultMaxFieldSize bounds plain form fields, which are buffered in memory
+const defaultMaxFieldSize = 1 << 20
+
+// UploadConfig limits what a multipart upload may contain.
+// Zero values mean no limit, except for MaxFieldSize.
+type UploadConfig struct {
+	MaxFileSize  int64
+	MaxTotalSize int64
+	MaxFiles     int
+	// MaxFieldSize limits each plain form field, 1 MiB when zero and no limit when negative
+	MaxFieldSize int64
+	// AllowedTypes lists MIME types detected by content sniffing,
+	// e.g. "image/png" or "image/*"
+	AllowedTypes []string
+	// TempDir is where SaveUploads writes files, os.TempDir() when empty
+	TempDir string
+}
+
+// FilePart is a single file of a multipart upload being streamed from the request
+type FilePart struct {
+	FieldName   string
+	Filename    string
+	ContentType string
+
+	reader io.Reader
+}
+
+// Read reads the file contents while enforcing the configured size limits
+func (p *FilePart) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// CopyTo streams the file contents into w
+func (p *FilePart) CopyTo(w io.Writer) (int64, error) {
+	return io.Copy(w, p.reader)
+}
+
+// UploadedFile describes a file that SaveUploads has written to disk
+type UploadedFile struct {
+	FieldName   string
+	Filename    string
+	ContentType string
+	Size        int64
+	Path        string
+}
+
+// MultipartReader returns a streaming reader over the multipart request body
+func (c *Context) MultipartReader() (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(string(c.Request.Header.ContentType()))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, ErrNotMultipart
+	}
+
+	var body io.Reader
+	if c.Request.IsBodyStream() {
+		body = c.RequestBodyStream()
+	} else {
+		body = bytes.NewReader(c.PostBody())
+	}
+	return multipart.NewReader(body, params["boundary"]), nil
+}
+
+// Upload streams every file in the multipart body to fn without buffering it in memory.
+// Plain form fields are stored in the returned map.
+func (c *Context) Upload(cfg UploadConfig, fn func(part *FilePart) error) (map[string][]string, error) {
+	reader, err := c.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string][]string)
+	total := &limitCounter{limit: cfg.MaxTotalSize, err: ErrUploadTooLarge}
+	files := 0
+	if cfg.MaxFieldSize == 0 {
+		cfg.MaxFieldSize = defaultMaxFieldSize
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, NewHTTPError(fasthttp.StatusBadRequest, "malformed multipart body: "+err.Error())
+		}
+
+		if part.FileName() == "" {
+			field := &limitCounter{limit: cfg.MaxFieldSize, err: ErrFieldTooLarge}
+			value, err := io.ReadAll(field.wrap(total.wrap(part)))
+			_ = part.Close()
+			if err != nil {
+				return nil, err
+			}
+			fields[part.FormName()] = append(fields[part.FormName()], string(value))
+			continue
+		}
+
+		files++
+		if cfg.MaxFiles > 0 && files > cfg.MaxFiles {
+			_ = part.Close()
+			return nil, ErrTooManyFiles
+		}
+
+		filePart, err := newFilePart(part, total, cfg)
+		if err != nil {
+			_ = part.Close()
+			return nil, err
+		}
+
+		err = fn(filePart)
+		_ = part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// SaveUploads streams every uploaded file into a temporary file.
+// The files are removed automatically once the request has finished.
+func (c *Context) SaveUploads(cfg UploadConfig) ([]*UploadedFile, map[string][]string, error) {
+	var saved []*UploadedFile
+	c.OnDone(func() {
+		for _, file := range saved {
+			_ = os.Remove(file.Path)
+		}
+	})
+
+	fields, err := c.Upload(cfg, func(part *FilePart) error {
+		tmp, err := os.CreateTemp(cfg.TempDir, "closure-upload-*"+filepath.Ext(filepath.Base(part.Filename)))
+		if err != nil {
+			return err
+		}
+
+		file := &UploadedFile{
+			FieldName:   part.FieldName,
+			Filename:    part.Filename,
+			ContentType: part.ContentType,
+			Path:        tmp.Name(),
+		}
+		saved = append(saved, file)
+
+		file.Size, err = part.CopyTo(tmp)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return saved, fields, nil
+}
+
+// newFilePart sniffs the content type of part and wraps it with the upload limits
+func newFilePart(part *multipart.Part, total *limitCounter, cfg UploadConfig) (*FilePart, error) {
+	perFile := &limitCounter{limit: cfg.MaxFileSize, err: ErrFileTooLarge}
+	reader := perFile.wrap(total.wrap(part))
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	head = head[:n]
+
+	contentType := http.DetectContentType(head)
+	if !mimeAllowed(contentType, cfg.AllowedTypes) {
+		return nil, ErrFileTypeRejected
+	}
+
+	return &FilePart{
+		FieldName:   part.FormName(),
+		Filename:    part.FileName(),
+		ContentType: contentType,
+		reader:      io.MultiReader(bytes.NewReader(head), reader),
+	}, nil
+}
+
+// mimeAllowed matches a sniffed content type against the allowed list
+func mimeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// limitCounter counts bytes read through the readers it wraps and fails once limit is passed
+type limitCounter struct {
+	limit int64
+	read  int64
+	err   error
+}
+
+func (l *limitCounter) wrap(r io.Reader) io.Reader {
+	return &limitedReader{reader: r, counter: l}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	counter *limitCounter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.counter.read += int64(n)
+	if r.counter.limit > 0 && r.counter.read > r.counter.limit {
+		return n, r.counter.err
+	}
+	return n, err
+}
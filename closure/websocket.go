@@ -0,0 +1,307 @@
+package closure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+)
+
+// WebSocket message types
+const (
+	TextMessage   = websocket.TextMessage
+	BinaryMessage = websocket.BinaryMessage
+)
+
+// WebSocket close codes
+const (
+	CloseNormalClosure   = websocket.CloseNormalClosure
+	CloseGoingAway       = websocket.CloseGoingAway
+	CloseMessageTooBig   = websocket.CloseMessageTooBig
+	ClosePolicyViolation = websocket.ClosePolicyViolation
+)
+
+// WSHandler runs for the lifetime of an upgraded WebSocket connection
+type WSHandler func(conn *WSConn) error
+
+// WSConfig tunes WebSocket endpoints. Zero values fall back to the defaults below.
+type WSConfig struct {
+	// ReadLimit is the maximum size in bytes of a message read from the client
+	ReadLimit int64
+	// PingInterval is how often the server pings the client
+	PingInterval time.Duration
+	// PongTimeout closes the connection when no pong arrives in time
+	PongTimeout time.Duration
+	// WriteTimeout bounds every single write to the client
+	WriteTimeout time.Duration
+	// EnableCompression negotiates permessage-deflate with the client
+	EnableCompression bool
+	Subprotocols      []string
+	// CheckOrigin decides whether a cross-origin upgrade is accepted,
+	// by default only same-origin requests are
+	CheckOrigin func(ctx *Context) bool
+}
+
+func defaultWSConfig() WSConfig {
+	return WSConfig{
+		ReadLimit:    1024 * 1024,
+		PingInterval: 30 * time.Second,
+		PongTimeout:  60 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+func (cfg WSConfig) withDefaults() WSConfig {
+	def := defaultWSConfig()
+	if cfg.ReadLimit <= 0 {
+		cfg.ReadLimit = def.ReadLimit
+	}
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = def.PingInterval
+	}
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = def.PongTimeout
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = def.WriteTimeout
+	}
+	return cfg
+}
+
+// WSConn is an upgraded WebSocket connection. Writes are safe for concurrent use.
+type WSConn struct {
+	Params map[string]string
+
+	conn      *websocket.Conn
+	config    WSConfig
+	writeMu   sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ReadMessage blocks until the next data message arrives
+func (c *WSConn) ReadMessage() (messageType int, data []byte, err error) {
+	return c.conn.ReadMessage()
+}
+
+// ReadJSON reads the next message and decodes it into v
+func (c *WSConn) ReadJSON(v any) error {
+	return c.conn.ReadJSON(v)
+}
+
+// WriteMessage sends a text or binary message
+func (c *WSConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// WriteJSON encodes v as JSON and sends it as a text message
+func (c *WSConn) WriteJSON(v any) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	return c.conn.WriteJSON(v)
+}
+
+// CloseWith sends a close frame with the given code and reason and closes the connection
+func (c *WSConn) CloseWith(code int, reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		message := websocket.FormatCloseMessage(code, reason)
+		_ = c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(c.config.WriteTimeout))
+		err = c.conn.Close()
+		close(c.done)
+	})
+	return err
+}
+
+// Close closes the connection with a normal closure
+func (c *WSConn) Close() error {
+	return c.CloseWith(CloseNormalClosure, "")
+}
+
+// Done is closed once the connection has been closed
+func (c *WSConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Subprotocol returns the negotiated subprotocol
+func (c *WSConn) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// IsUnexpectedClose reports whether err is a close error other than a normal or going-away closure
+func IsUnexpectedClose(err error) bool {
+	return websocket.IsUnexpectedCloseError(err, CloseNormalClosure, CloseGoingAway)
+}
+
+// keepAlive pings the client until the connection closes.
+// Reads fail once no pong has arrived within PongTimeout.
+func (c *WSConn) keepAlive() {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(c.config.WriteTimeout)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				_ = c.CloseWith(CloseGoingAway, "ping failed")
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// wsRegistry keeps track of live connections so they can be closed on shutdown
+type wsRegistry struct {
+	mu    sync.Mutex
+	conns map[*WSConn]struct{}
+	// closed refuses new connections once shutdown has started
+	closed bool
+}
+
+func newWSRegistry() *wsRegistry {
+	return &wsRegistry{conns: make(map[*WSConn]struct{})}
+}
+
+// add tracks conn, returning false when the registry is already closed
+func (r *wsRegistry) add(conn *WSConn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.conns[conn] = struct{}{}
+	return true
+}
+
+func (r *wsRegistry) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func (r *wsRegistry) remove(conn *WSConn) {
+	r.mu.Lock()
+	delete(r.conns, conn)
+	r.mu.Unlock()
+}
+
+// closeAll refuses new connections, sends a going-away close frame to every
+// connection and waits for their handlers to return or ctx to expire
+func (r *wsRegistry) closeAll(ctx context.Context) {
+	r.mu.Lock()
+	r.closed = true
+	conns := make([]*WSConn, 0, len(r.conns))
+	for conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.mu.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.CloseWith(CloseGoingAway, "server shutting down")
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for r.len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *wsRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// WebSocket registers a GET route that upgrades the connection and runs handler.
+// The upgrade request goes through the cluster middleware like any other route.
+func (c *Cluster) WebSocket(path string, handler WSHandler, config ...WSConfig) {
+	var cfg WSConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	c.registerRoute("GET", path, upgradeHandler(handler, cfg.withDefaults()))
+}
+
+func upgradeHandler(handler WSHandler, cfg WSConfig) Handler {
+	return func(ctx *Context) error {
+		upgrader := websocket.FastHTTPUpgrader{
+			EnableCompression: cfg.EnableCompression,
+			Subprotocols:      cfg.Subprotocols,
+			Error: func(_ *fasthttp.RequestCtx, status int, reason error) {
+				JSONError(ctx, status, reason.Error())
+			},
+		}
+		if cfg.CheckOrigin != nil {
+			upgrader.CheckOrigin = func(*fasthttp.RequestCtx) bool { return cfg.CheckOrigin(ctx) }
+		}
+
+		params := make(map[string]string, len(ctx.Params))
+		for key, value := range ctx.Params {
+			params[key] = value
+		}
+		registry := ctx.websockets()
+		if registry.isClosed() {
+			return NewHTTPError(fasthttp.StatusServiceUnavailable, "server is shutting down")
+		}
+
+		// The upgrader writes its own error response when the handshake fails
+		_ = upgrader.Upgrade(ctx.RequestCtx, func(conn *websocket.Conn) {
+			conn.SetReadLimit(cfg.ReadLimit)
+			conn.EnableWriteCompression(cfg.EnableCompression)
+
+			wsConn := &WSConn{
+				Params: params,
+				conn:   conn,
+				config: cfg,
+				done:   make(chan struct{}),
+			}
+			// Upgrades racing with shutdown are closed right away
+			if !registry.add(wsConn) {
+				_ = wsConn.CloseWith(CloseGoingAway, "server shutting down")
+				return
+			}
+			defer registry.remove(wsConn)
+
+			_ = conn.SetReadDeadline(time.Now().Add(cfg.PongTimeout))
+			conn.SetPongHandler(func(string) error {
+				return conn.SetReadDeadline(time.Now().Add(cfg.PongTimeout))
+			})
+			go wsConn.keepAlive()
+
+			err := handler(wsConn)
+			var closeErr *websocket.CloseError
+			switch {
+			case err == nil, errors.As(err, &closeErr):
+				_ = wsConn.Close()
+			case errors.Is(err, websocket.ErrReadLimit):
+				_ = wsConn.CloseWith(CloseMessageTooBig, "message too big")
+			default:
+				_ = wsConn.CloseWith(websocket.CloseInternalServerErr, "internal error")
+			}
+		})
+		return nil
+	}
+}
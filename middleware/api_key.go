@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+)
+
+var apiKeyKey = closure.NewKey[*APIKey]("api_key")
+
+// APIKey is the stored record of an API key. Only a hash of the key is kept, the
+// prefix identifies the key in logs and dashboards without revealing it.
+type APIKey struct {
+	// Prefix is the public part of the key before the ".", e.g. "sk_live_3kF9a2Qx"
+	Prefix string
+	// Hash is HashAPIKey of the whole key
+	Hash   []byte
+	Owner  string
+	Scopes []string
+	// Roles are checked by RequireRoles, GenerateAPIKey leaves them empty
+	Roles     []string
+	CreatedAt time.Time
+	// ExpiresAt is zero for keys that do not expire
+	ExpiresAt time.Time
+	LastUsed  time.Time
+}
+
+// claims presents the key to the authorization guards like a token
+func (k *APIKey) claims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": k.Owner, "scope": strings.Join(k.Scopes, " "), "roles": k.Roles}
+}
+
+// KeyStore looks up API keys by prefix. Implementations must be safe for concurrent use.
+type KeyStore interface {
+	// Lookup returns the key with prefix, or nil when there is none
+	Lookup(ctx context.Context, prefix string) (*APIKey, error)
+	// Touch records that the key with prefix was used at t
+	Touch(ctx context.Context, prefix string, t time.Time) error
+}
+
+// GenerateAPIKey creates a random key whose prefix starts with kind, e.g. "sk_live".
+// Kind may only contain letters, digits, "_" and "-". The key is shown to its owner
+// once, the returned record is what the KeyStore keeps.
+func GenerateAPIKey(kind, owner string, scopes ...string) (string, *APIKey, error) {
+	if strings.ContainsFunc(kind, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+	}) {
+		return "", nil, errors.New("api key kind may only contain letters, digits, _ and -")
+	}
+	random := make([]byte, 30)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(random)
+	prefix := encoded[:8]
+	if kind != "" {
+		prefix = kind + "_" + prefix
+	}
+
+	key := prefix + "." + encoded[8:]
+	return key, &APIKey{
+		Prefix:    prefix,
+		Hash:      HashAPIKey(key),
+		Owner:     owner,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// HashAPIKey returns the hash stored for key. Keys are long and random, so a fast
+// hash does not make guessing them practical.
+func HashAPIKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// APIKeyConfig configures APIKeyMiddleware. Zero values fall back to the defaults.
+type APIKeyConfig struct {
+	// Store holds the keys and is required
+	Store KeyStore
+	// Header carries the key, "X-API-Key" by default
+	Header string
+	// Query names a query parameter that may carry the key instead, none by default
+	// since URLs end up in logs
+	Query string
+	// TouchInterval limits how often the last use of a key is written, 1 minute by default
+	TouchInterval time.Duration
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// APIKeyMiddleware authenticates requests by API key and stores the key, with its owner
+// and scopes, for APIKeyFrom and the authorization guards. Invalid keys get 401.
+func APIKeyMiddleware(config APIKeyConfig) *closure.Middleware {
+	if config.Store == nil {
+		panic("middleware: APIKeyConfig.Store is required")
+	}
+	if config.Header == "" {
+		config.Header = "X-API-Key"
+	}
+	if config.TouchInterval <= 0 {
+		config.TouchInterval = time.Minute
+	}
+
+	return &closure.Middleware{
+		Name: "APIKey",
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				presented := string(ctx.Request.Header.Peek(config.Header))
+				if presented == "" && config.Query != "" {
+					presented = string(ctx.QueryArgs().Peek(config.Query))
+				}
+				if presented == "" {
+					return closure.NewHTTPError(fasthttp.StatusUnauthorized, "API key is missing")
+				}
+
+				key, err := verifyAPIKey(ctx.Context(), config.Store, presented, time.Now())
+				if err != nil {
+					if errors.Is(err, errInvalidAPIKey) {
+						return closure.NewHTTPError(fasthttp.StatusUnauthorized, err.Error())
+					}
+					return err
+				}
+
+				if now := time.Now(); now.Sub(key.LastUsed) >= config.TouchInterval {
+					if err := config.Store.Touch(ctx.Context(), key.Prefix, now); err != nil {
+						logging.Error("API key last use update failed: %s", err.Error())
+					}
+				}
+				apiKeyKey.Set(ctx, key)
+				return next(ctx)
+			}
+		},
+	}
+}
+
+// verifyAPIKey looks the key up by its prefix and compares the hashes in constant time
+func verifyAPIKey(ctx context.Context, store KeyStore, presented string, now time.Time) (*APIKey, error) {
+	prefix, _, ok := strings.Cut(presented, ".")
+	if !ok || prefix == "" {
+		return nil, errInvalidAPIKey
+	}
+	key, err := store.Lookup(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || subtle.ConstantTimeCompare(HashAPIKey(presented), key.Hash) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	if !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt) {
+		return nil, errInvalidAPIKey
+	}
+	return key, nil
+}
+
+// APIKeyFrom returns the key that authenticated the request
+func APIKeyFrom(ctx *closure.Context) (*APIKey, bool) {
+	return apiKeyKey.Get(ctx)
+}
+
+// MemoryKeyStore keeps API keys in process memory
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+// NewMemoryKeyStore creates a MemoryKeyStore holding keys
+func NewMemoryKeyStore(keys ...*APIKey) *MemoryKeyStore {
+	s := &MemoryKeyStore{keys: make(map[string]APIKey, len(keys))}
+	for _, key := range keys {
+		s.Add(key)
+	}
+	return s
+}
+
+// Add stores key, replacing a key with the same prefix
+func (s *MemoryKeyStore) Add(key *APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.Prefix] = *key
+}
+
+// Remove deletes the key with prefix, revoking it
+func (s *MemoryKeyStore) Remove(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, prefix)
+}
+
+// Lookup implements KeyStore. It returns a copy, so callers can not change the stored key.
+func (s *MemoryKeyStore) Lookup(_ context.Context, prefix string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[prefix]
+	if !ok {
+		return nil, nil
+	}
+	key.Scopes = slices.Clone(key.Scopes)
+	key.Roles = slices.Clone(key.Roles)
+	return &key, nil
+}
+
+// Touch implements KeyStore
+func (s *MemoryKeyStore) Touch(_ context.Context, prefix string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[prefix]; ok && t.After(key.LastUsed) {
+		key.LastUsed = t
+		s.keys[prefix] = key
+	}
+	return nil
+}
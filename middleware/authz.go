@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+)
+
+// RequireRoles lets requests through whose token has any of roles in its "roles" or
+// "role" claim, others get 403. It belongs behind JWTMiddleware or APIKeyMiddleware.
+func RequireRoles(roles ...string) *closure.Middleware {
+	return guard("RequireRoles("+strings.Join(roles, ",")+")", func(ctx *closure.Context, claims jwt.MapClaims) string {
+		granted := claimValues(claims, "roles", "role")
+		for _, role := range roles {
+			if granted[role] {
+				return ""
+			}
+		}
+		return "requires role " + strings.Join(roles, " or ")
+	})
+}
+
+// RequireScopes lets requests through whose token has all of scopes in its "scope"
+// or "scp" claim, others get 403. It belongs behind JWTMiddleware or APIKeyMiddleware.
+func RequireScopes(scopes ...string) *closure.Middleware {
+	return guard("RequireScopes("+strings.Join(scopes, ",")+")", func(ctx *closure.Context, claims jwt.MapClaims) string {
+		granted := claimValues(claims, "scope", "scp")
+		for _, scope := range scopes {
+			if !granted[scope] {
+				return "missing scope " + scope
+			}
+		}
+		return ""
+	})
+}
+
+// RequirePolicy lets requests through for which allow returns true, others get 403.
+// It belongs behind JWTMiddleware or APIKeyMiddleware.
+func RequirePolicy(allow func(ctx *closure.Context, claims jwt.MapClaims) bool) *closure.Middleware {
+	return guard("RequirePolicy", func(ctx *closure.Context, claims jwt.MapClaims) string {
+		if allow(ctx, claims) {
+			return ""
+		}
+		return "denied by policy"
+	})
+}
+
+// guard builds an authorization middleware from check, which returns why the
+// request is forbidden or "" to let it through. Requests authenticated by API key
+// are checked with its owner as sub, its scopes as scope and its roles as roles.
+func guard(name string, check func(ctx *closure.Context, claims jwt.MapClaims) string) *closure.Middleware {
+	return &closure.Middleware{
+		Name: name,
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				claims, ok := JWTClaimsKey.Get(ctx)
+				if !ok {
+					key, ok := APIKeyFrom(ctx)
+					if !ok {
+						return closure.NewHTTPError(fasthttp.StatusUnauthorized, "Unauthorized")
+					}
+					claims = key.claims()
+				}
+				if reason := check(ctx, claims); reason != "" {
+					return closure.NewHTTPError(fasthttp.StatusForbidden, "Forbidden: "+reason)
+				}
+				return next(ctx)
+			}
+		},
+	}
+}
+
+// claimValues collects the values of the first present claim in names, which may be
+// a list or a space separated string as OAuth uses for scope
+func claimValues(claims jwt.MapClaims, names ...string) map[string]bool {
+	values := make(map[string]bool)
+	for _, name := range names {
+		switch claim := claims[name].(type) {
+		case string:
+			for _, value := range strings.Fields(claim) {
+				values[value] = true
+			}
+		case []any:
+			for _, value := range claim {
+				if s, ok := value.(string); ok {
+					values[s] = true
+				}
+			}
+		case []string:
+			for _, value := range claim {
+				values[value] = true
+			}
+		default:
+			continue
+		}
+		return values
+	}
+	return values
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	"github.com/valyala/fasthttp"
+)
+
+var authUserKey = closure.NewKey[string]("auth_user")
+
+// AuthUser returns the user authenticated by BasicAuthMiddleware or DigestAuthMiddleware
+func AuthUser(ctx *closure.Context) (string, bool) {
+	return authUserKey.Get(ctx)
+}
+
+// UserLookup returns the password of user, and false when there is no such user
+type UserLookup func(ctx *closure.Context, user string) (string, bool)
+
+// BasicAuthConfig configures BasicAuthMiddleware. Zero values fall back to the defaults.
+type BasicAuthConfig struct {
+	// Lookup finds the password of a user and is required
+	Lookup UserLookup
+	// Realm is shown by browsers in the login prompt, "Restricted" by default
+	Realm string
+}
+
+// BasicAuthMiddleware authenticates requests with HTTP Basic auth (RFC 7617). Passwords
+// travel in the clear, so it belongs behind TLS. Failed requests get 401 with a challenge.
+func BasicAuthMiddleware(config BasicAuthConfig) *closure.Middleware {
+	if config.Lookup == nil {
+		panic("middleware: BasicAuthConfig.Lookup is required")
+	}
+	if config.Realm == "" {
+		config.Realm = "Restricted"
+	}
+	challenge := `Basic realm="` + quoteAuthParam(config.Realm) + `", charset="UTF-8"`
+
+	return &closure.Middleware{
+		Name: "BasicAuth",
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				user, password, ok := parseBasicAuth(string(ctx.Request.Header.Peek("Authorization")))
+				if ok {
+					stored, exists := config.Lookup(ctx, user)
+					// Unknown users are compared too, so they take as long as wrong passwords
+					if passwordsEqual(password, stored) && exists {
+						authUserKey.Set(ctx, user)
+						return next(ctx)
+					}
+				}
+				ctx.Response.Header.Set("WWW-Authenticate", challenge)
+				return closure.NewHTTPError(fasthttp.StatusUnauthorized, "Unauthorized")
+			}
+		},
+	}
+}
+
+func parseBasicAuth(header string) (string, string, bool) {
+	scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// passwordsEqual compares in constant time, hashing first so the length does not leak either
+func passwordsEqual(given, stored string) bool {
+	a := sha256.Sum256([]byte(given))
+	b := sha256.Sum256([]byte(stored))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// quoteAuthParam escapes a value for a quoted-string in an authentication header
+func quoteAuthParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+}
@@ -1,11 +1,20 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/SwanHtetAungPhyo/swantemp/closure"
-	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/valyala/fasthttp"
 )
 
 type rateMapper struct {
@@ -16,60 +25,519 @@ type rateMapper struct {
 
 var statement = fmt.Sprintf("%s[CLOCACHE] %s", cyan, reset)
 
-type cacheEntry struct {
-	data    []byte
-	expires int64
+// CacheConfig configures CacheMiddleware. Zero values fall back to the defaults.
+type CacheConfig struct {
+	// TTL is the lifetime of responses that carry neither max-age nor Expires, 1 minute by default
+	TTL time.Duration
+	// Store holds the responses, a MemoryCacheStore of MaxBytes by default
+	Store CacheStore
+	// MaxBytes bounds the memory of the default store, 64 MB by default
+	MaxBytes int64
+	// SweepInterval is how often expired responses are dropped from stores with a
+	// Cleanup method, 1 minute by default
+	SweepInterval time.Duration
+	// StaleWhileRevalidate and StaleIfError apply to responses without the matching
+	// Cache-Control directive. Both are zero by default.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// FillTimeout bounds how long a request waits for a concurrent miss of the
+	// same URL before calling the handler itself, 10 seconds by default
+	FillTimeout time.Duration
+	// SharePrivateRequests lets requests carrying Cookie or Authorization use the cache.
+	// They bypass it by default since their responses are usually personal. When set,
+	// responses to Authorization requests are still only stored when marked public.
+	SharePrivateRequests bool
+	// PassTTL is how long requests for a URL whose response could not be stored skip
+	// the coalescing of misses and go straight to the handler, 10 seconds by default
+	PassTTL time.Duration
 }
 
-func CacheMiddleware(ttl time.Duration) *closure.Middleware {
-	var (
-		cache sync.Map
-		_     sync.RWMutex
-	)
+var (
+	cacheTagsKey  = closure.NewKey[[]string]("cache_tags")
+	cacheStoreKey = closure.NewKey[CacheStore]("cache_store")
+)
 
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
-		for range ticker.C {
-			now := time.Now().Unix()
-			cache.Range(func(key, value interface{}) bool {
-				if entry := value.(*cacheEntry); entry.expires < now {
-					cache.Delete(key)
-				}
-				return true
-			})
-		}
-	}()
+// TagCache tags the response of the current request, so that it can be removed
+// later with PurgeCache or CacheStore.Purge, e.g. "user:42"
+func TagCache(ctx *closure.Context, tags ...string) {
+	existing, _ := cacheTagsKey.Get(ctx)
+	cacheTagsKey.Set(ctx, append(existing, tags...))
+}
+
+// PurgeCache removes every cached response carrying one of tags from the store
+// of the CacheMiddleware the request went through
+func PurgeCache(ctx *closure.Context, tags ...string) error {
+	store, ok := cacheStoreKey.Get(ctx)
+	if !ok {
+		return nil
+	}
+	var errs []error
+	for _, tag := range tags {
+		errs = append(errs, store.Purge(tag))
+	}
+	return errors.Join(errs...)
+}
+
+// cacheableStatuses are the statuses a shared cache may store without explicit freshness
+var cacheableStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// uncachedHeaders are never stored with a response
+var uncachedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+	"Date":              true,
+	"Age":               true,
+	"X-Cache":           true,
+}
+
+// CacheMiddleware is a shared HTTP cache for GET and HEAD requests. It stores full
+// responses for as long as Cache-Control, Expires or the configured TTL allow,
+// keys them on the headers listed in Vary and marks responses with Age and
+// X-Cache. The sweeper starts with the first request and stops with the App.
+//
+// Concurrent misses for one URL are coalesced into a single handler call, unless
+// the last response of the URL could not be stored.
+// Expired responses are served during stale-while-revalidate while one
+// background refresh runs, and during stale-if-error when the handler fails.
+func CacheMiddleware(config CacheConfig) *closure.Middleware {
+	if config.TTL <= 0 {
+		config.TTL = time.Minute
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryCacheStore(config.MaxBytes)
+	}
+	if config.SweepInterval <= 0 {
+		config.SweepInterval = time.Minute
+	}
+	if config.FillTimeout <= 0 {
+		config.FillTimeout = 10 * time.Second
+	}
+	if config.PassTTL <= 0 {
+		config.PassTTL = 10 * time.Second
+	}
+	store := config.Store
+	fills := &cacheFills{inFlight: make(map[string]chan struct{}), pass: make(map[string]time.Time)}
+	var sweeper sync.Once
 
 	return &closure.Middleware{
+		Name: "Cache",
 		Handler: func(next closure.Handler) closure.Handler {
 			return func(ctx *closure.Context) error {
-				cacheKey := ctx.URI().String()
+				sweeper.Do(func() {
+					if cleaner, ok := store.(cacheCleaner); ok {
+						go sweepCache(ctx.ServerContext(), cleaner, config.SweepInterval)
+					}
+				})
+				cacheStoreKey.Set(ctx, store)
+				if !ctx.IsGet() && !ctx.IsHead() {
+					return next(ctx)
+				}
+				if !config.SharePrivateRequests && privateRequest(ctx) {
+					return next(ctx)
+				}
 
-				if val, ok := cache.Load(cacheKey); ok {
-					entry := val.(*cacheEntry)
-					if time.Now().Unix() < entry.expires {
-						ctx.SetBody(entry.data)
+				requestCC := parseCacheControl(ctx.Request.Header.Peek("Cache-Control"))
+				if requestCC.has("no-store") {
+					return next(ctx)
+				}
+				key := cacheKey(ctx)
+				if requestCC.has("no-cache") || requestCC["max-age"] == "0" {
+					return fillCache(ctx, next, store, fills, key, nil, config)
+				}
+
+				now := time.Now()
+				stale := lookupCached(store, key, ctx)
+				if stale != nil {
+					if stale.Fresh(now) {
+						serveCached(ctx, stale, now, "HIT")
+						return nil
+					}
+					if !now.After(stale.StaleUntil) {
+						if fills.start(key) {
+							refreshCached(ctx, next, store, fills, key, config)
+						}
+						serveCached(ctx, stale, now, "STALE")
 						return nil
 					}
 				}
 
-				err := next(ctx)
-				if err != nil {
-					return err
+				// Responses that were not cacheable a moment ago are not waited for
+				if fills.passing(key, now) {
+					return fillCache(ctx, next, store, fills, key, stale, config)
+				}
+				// Only one request per URL runs the handler, the others wait for its response
+				if !fills.start(key) {
+					if fills.wait(ctx, key, config.FillTimeout) {
+						now = time.Now()
+						if entry := lookupCached(store, key, ctx); entry != nil && entry.Fresh(now) {
+							serveCached(ctx, entry, now, "HIT")
+							return nil
+						}
+					}
+					return fillCache(ctx, next, store, fills, key, stale, config)
 				}
+				defer fills.finish(key)
+				return fillCache(ctx, next, store, fills, key, stale, config)
+			}
+		},
+	}
+}
 
-				cache.Store(cacheKey, &cacheEntry{
-					data:    ctx.Response.Body(),
-					expires: time.Now().Add(ttl).Unix(),
-				})
+// fillCache runs the handler and stores its response. A failed handler falls
+// back to stale while its stale-if-error window lasts. URLs whose response can
+// not be stored are marked to pass for PassTTL.
+func fillCache(ctx *closure.Context, next closure.Handler, store CacheStore, fills *cacheFills, key string, stale *CachedResponse, config CacheConfig) error {
+	err := next(ctx)
+	now := time.Now()
+	if stale != nil && !now.After(stale.StaleIfErrorUntil) && (err != nil || ctx.Response.StatusCode() >= 500) {
+		serveCached(ctx, stale, now, "STALE")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if ctx.IsGet() {
+		if entry := newCacheEntry(ctx, config, now); entry != nil {
+			storeCached(store, key, ctx, entry)
+			fills.unpass(key)
+		} else {
+			fills.markPass(key, now.Add(config.PassTTL))
+		}
+	}
+	ctx.Response.Header.Set("X-Cache", "MISS")
+	return nil
+}
+
+// refreshCached runs the handler for a copy of the request in the background
+func refreshCached(ctx *closure.Context, next closure.Handler, store CacheStore, fills *cacheFills, key string, config CacheConfig) {
+	detached, release := ctx.Detach()
+	go func() {
+		defer fills.finish(key)
+		defer release()
+		defer func() {
+			if rec := recover(); rec != nil {
+				logging.Error("cache refresh of %s panicked: %v", key, rec)
+			}
+		}()
+
+		if err := next(detached); err != nil {
+			return
+		}
+		if entry := newCacheEntry(detached, config, time.Now()); entry != nil {
+			storeCached(store, key, detached, entry)
+		}
+	}()
+}
+
+// cacheFills tracks the handler calls filling the cache, one per URL, and the
+// URLs whose responses were not cacheable, so that their requests are not held up
+type cacheFills struct {
+	mu       sync.Mutex
+	inFlight map[string]chan struct{}
+	pass     map[string]time.Time
+}
+
+// start reports whether the caller should fill key, false when another request already is
+func (f *cacheFills) start(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.inFlight[key]; ok {
+		return false
+	}
+	f.inFlight[key] = make(chan struct{})
+	return true
+}
+
+// wait blocks until the fill of key finishes and reports whether it did in time
+func (f *cacheFills) wait(ctx *closure.Context, key string, timeout time.Duration) bool {
+	f.mu.Lock()
+	done, ok := f.inFlight[key]
+	f.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Context().Done():
+		return false
+	}
+}
+
+// passing reports whether key was marked to pass and the mark has not expired
+func (f *cacheFills) passing(key string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	until, ok := f.pass[key]
+	if ok && !now.Before(until) {
+		delete(f.pass, key)
+		return false
+	}
+	return ok
+}
+
+func (f *cacheFills) markPass(key string, until time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Expired marks of URLs that were not requested again are dropped as more arrive
+	if len(f.pass) >= maxPassMarks {
+		now := time.Now()
+		for marked, expires := range f.pass {
+			if !now.Before(expires) {
+				delete(f.pass, marked)
+			}
+		}
+		if len(f.pass) >= maxPassMarks {
+			return
+		}
+	}
+	f.pass[key] = until
+}
 
+func (f *cacheFills) unpass(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.pass, key)
+}
+
+func (f *cacheFills) finish(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if done, ok := f.inFlight[key]; ok {
+		close(done)
+		delete(f.inFlight, key)
+	}
+}
+
+// maxPassMarks bounds the URLs remembered as uncacheable
+const maxPassMarks = 10000
+
+// cacheKey identifies a URL. HEAD requests share the entries of GET.
+func cacheKey(ctx *closure.Context) string {
+	return "GET " + string(ctx.Host()) + string(ctx.RequestURI())
+}
+
+// variantKey extends key with the request's values of the Vary headers
+func variantKey(key string, vary []string, ctx *closure.Context) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.Write(ctx.Request.Header.Peek(name))
+	}
+	return b.String()
+}
+
+// lookupCached returns the stored response for the request, which may be stale.
+// Store failures are logged and treated as misses.
+func lookupCached(store CacheStore, key string, ctx *closure.Context) *CachedResponse {
+	entry, err := store.Get(key)
+	if err == nil && entry != nil && entry.Status == 0 {
+		entry, err = store.Get(variantKey(key, entry.Vary, ctx))
+	}
+	if err != nil {
+		logging.Error("cache lookup failed: %s", err.Error())
+		return nil
+	}
+	return entry
+}
+
+func storeCached(store CacheStore, key string, ctx *closure.Context, entry *CachedResponse) {
+	var err error
+	if len(entry.Vary) == 0 {
+		err = store.Set(key, entry)
+	} else {
+		// The index outlives every variant it points to
+		retain := entry.RetainUntil()
+		if index, _ := store.Get(key); index != nil && index.Expires.After(retain) {
+			retain = index.Expires
+		}
+		err = store.Set(key, &CachedResponse{Vary: entry.Vary, StoredAt: entry.StoredAt, Expires: retain})
+		if err == nil {
+			err = store.Set(variantKey(key, entry.Vary, ctx), entry)
+		}
+	}
+	if err != nil {
+		logging.Error("cache store failed: %s", err.Error())
+	}
+}
+
+// sweepCache removes expired responses every interval until ctx is done
+func sweepCache(ctx context.Context, cleaner cacheCleaner, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := cleaner.Cleanup(); err != nil {
+				logging.Error("cache cleanup failed: %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newCacheEntry captures the response, or returns nil when it must not be stored
+func newCacheEntry(ctx *closure.Context, config CacheConfig, now time.Time) *CachedResponse {
+	if !cacheableStatuses[ctx.Response.StatusCode()] || ctx.IsBodyStream() {
+		return nil
+	}
+	// Cookies belong to one client
+	if len(ctx.Response.Header.Peek("Set-Cookie")) > 0 {
+		return nil
+	}
+
+	cc := parseCacheControl(ctx.Response.Header.Peek("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") || cc.has("no-cache") {
+		return nil
+	}
+	// Responses to authenticated requests are only shared when marked so
+	if len(ctx.Request.Header.Peek("Authorization")) > 0 && !cc.has("public") && !cc.has("s-maxage") {
+		return nil
+	}
+
+	ttl, ok := responseTTL(ctx, cc, config, now)
+	if !ok || ttl <= 0 {
+		return nil
+	}
+
+	var vary []string
+	for _, field := range ctx.Response.Header.PeekAll("Vary") {
+		for _, name := range strings.Split(string(field), ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
 				return nil
 			}
-		},
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+
+	tags, _ := cacheTagsKey.Get(ctx)
+	entry := &CachedResponse{
+		Status:   ctx.Response.StatusCode(),
+		Body:     append([]byte(nil), ctx.Response.Body()...),
+		Vary:     vary,
+		Tags:     tags,
+		StoredAt: now,
+		Expires:  now.Add(ttl),
 	}
+	entry.StaleUntil = entry.Expires.Add(staleWindow(cc, "stale-while-revalidate", config.StaleWhileRevalidate))
+	entry.StaleIfErrorUntil = entry.Expires.Add(staleWindow(cc, "stale-if-error", config.StaleIfError))
+	ctx.Response.Header.VisitAll(func(key, value []byte) {
+		if name := string(key); !uncachedHeaders[name] {
+			entry.Header = append(entry.Header, [2]string{name, string(value)})
+		}
+	})
+	return entry
 }
-func LoggerMiddleware() *closure.Middleware {
+
+// responseTTL reads the freshness lifetime from s-maxage, max-age or Expires
+func responseTTL(ctx *closure.Context, cc cacheControl, config CacheConfig, now time.Time) (time.Duration, bool) {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires := ctx.Response.Header.Peek("Expires"); len(expires) > 0 {
+		at, err := http.ParseTime(string(expires))
+		if err != nil {
+			return 0, false
+		}
+		return at.Sub(now), true
+	}
+	return config.TTL, true
+}
+
+// staleWindow reads a stale-* directive, falling back to the configured default
+func staleWindow(cc cacheControl, directive string, fallback time.Duration) time.Duration {
+	if value, ok := cc[directive]; ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+	return fallback
+}
+
+// privateRequest reports whether the request carries credentials of one client
+func privateRequest(ctx *closure.Context) bool {
+	return len(ctx.Request.Header.Peek("Authorization")) > 0 || len(ctx.Request.Header.Peek("Cookie")) > 0
+}
+
+func serveCached(ctx *closure.Context, entry *CachedResponse, now time.Time, status string) {
+	ctx.Response.ResetBody()
+	// Stored headers replace the handler's, keeping every value of repeated ones
+	for _, field := range entry.Header {
+		ctx.Response.Header.Del(field[0])
+	}
+	for _, field := range entry.Header {
+		ctx.Response.Header.Add(field[0], field[1])
+	}
+	ctx.SetStatusCode(entry.Status)
+	ctx.SetBody(entry.Body)
+	ctx.Response.Header.Set("Age", strconv.Itoa(int(now.Sub(entry.StoredAt).Seconds())))
+	ctx.Response.Header.Set("X-Cache", status)
+
+	if entry.Status == fasthttp.StatusOK {
+		modTime, _ := http.ParseTime(entry.header("Last-Modified"))
+		ctx.CheckPreconditions(entry.header("ETag"), modTime)
+	}
+}
+
+// cacheControl holds Cache-Control directives by lower-cased name
+type cacheControl map[string]string
+
+func parseCacheControl(header []byte) cacheControl {
+	cc := make(cacheControl)
+	for _, directive := range strings.Split(string(header), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// LoggerConfig configures LoggerMiddleware. Zero values fall back to the defaults.
+type LoggerConfig struct {
+	// Locals names the typed request locals added to each line, e.g. "auth_user".
+	// None are logged by default since locals may hold claims, keys or secrets.
+	Locals []string
+}
+
+// LoggerMiddleware logs the method, URI, status, duration and client IP of every request
+func LoggerMiddleware(config ...LoggerConfig) *closure.Middleware {
+	var cfg LoggerConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
 	return &closure.Middleware{
 		Name: "Logger",
 		Handler: func(next closure.Handler) closure.Handler {
@@ -83,12 +551,23 @@ func LoggerMiddleware() *closure.Middleware {
 				method := string(ctx.Method())
 				clientIP := ctx.RemoteIP()
 
+				var locals strings.Builder
+				if len(cfg.Locals) > 0 {
+					ctx.VisitLocals(func(name string, value any) {
+						if slices.Contains(cfg.Locals, name) {
+							fmt.Fprintf(&locals, " %s: %v", name, value)
+						}
+					})
+				}
+
 				logging.Info(
-					"Method:", method,
-					"Routes:", req.URI().String(),
-					"Status:", statusCode,
-					"Duration:", duration,
-					"ClientIP:", clientIP,
+					"Method: %s Routes: %s Status: %d Duration: %v ClientIP: %s%s",
+					method,
+					req.URI().String(),
+					statusCode,
+					duration,
+					clientIP,
+					locals.String(),
 				)
 
 				return response
@@ -0,0 +1,590 @@
+package middleware
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// CacheStore holds the responses of CacheMiddleware. Get returns nil and no error
+// for unknown keys and for responses past their retention.
+type CacheStore interface {
+	Get(key string) (*CachedResponse, error)
+	Set(key string, response *CachedResponse) error
+	Delete(key string) error
+	// Purge removes every response tagged with tag
+	Purge(tag string) error
+}
+
+// CachedResponse is a stored response. Responses with a zero Status are Vary
+// indexes that list the request headers the variants of a URL are keyed on.
+type CachedResponse struct {
+	Status   int         `json:"status"`
+	Header   [][2]string `json:"header,omitempty"`
+	Body     []byte      `json:"body,omitempty"`
+	Vary     []string    `json:"vary,omitempty"`
+	Tags     []string    `json:"tags,omitempty"`
+	StoredAt time.Time   `json:"stored_at"`
+	Expires  time.Time   `json:"expires"`
+	// StaleUntil and StaleIfErrorUntil extend the use of an expired response, see RFC 5861
+	StaleUntil        time.Time `json:"stale_until"`
+	StaleIfErrorUntil time.Time `json:"stale_if_error_until"`
+}
+
+// Fresh reports whether the response can be served without revalidation
+func (r *CachedResponse) Fresh(now time.Time) bool {
+	return !now.After(r.Expires)
+}
+
+// RetainUntil is the last moment the response can be served in any form
+func (r *CachedResponse) RetainUntil() time.Time {
+	until := r.Expires
+	if r.StaleUntil.After(until) {
+		until = r.StaleUntil
+	}
+	if r.StaleIfErrorUntil.After(until) {
+		until = r.StaleIfErrorUntil
+	}
+	return until
+}
+
+// size approximates the memory held by the response
+func (r *CachedResponse) size() int64 {
+	n := int64(len(r.Body)) + 64
+	for _, field := range r.Header {
+		n += int64(len(field[0]) + len(field[1]))
+	}
+	for _, name := range r.Vary {
+		n += int64(len(name))
+	}
+	for _, tag := range r.Tags {
+		n += int64(len(tag))
+	}
+	return n
+}
+
+// header returns the first stored value of a response header
+func (r *CachedResponse) header(name string) string {
+	for _, field := range r.Header {
+		if strings.EqualFold(field[0], name) {
+			return field[1]
+		}
+	}
+	return ""
+}
+
+func (r *CachedResponse) hasTag(tag string) bool {
+	for _, t := range r.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryCacheStore is an LRU of responses bounded by their total size
+type MemoryCacheStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	entries  map[string]*list.Element
+	order    *list.List
+	tags     map[string]map[string]struct{}
+}
+
+type memoryCacheItem struct {
+	key      string
+	response *CachedResponse
+	size     int64
+}
+
+// NewMemoryCacheStore creates an in-memory store holding at most maxBytes of responses
+func NewMemoryCacheStore(maxBytes int64) *MemoryCacheStore {
+	if maxBytes <= 0 {
+		maxBytes = 64 << 20
+	}
+	return &MemoryCacheStore{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		tags:     make(map[string]map[string]struct{}),
+	}
+}
+
+func (m *MemoryCacheStore) Get(key string) (*CachedResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	item := element.Value.(*memoryCacheItem)
+	if time.Now().After(item.response.RetainUntil()) {
+		m.removeElement(element)
+		return nil, nil
+	}
+	m.order.MoveToFront(element)
+	return item.response, nil
+}
+
+// Set stores response, evicting the least recently used responses beyond the budget.
+// The response must not be modified afterwards.
+func (m *MemoryCacheStore) Set(key string, response *CachedResponse) error {
+	size := response.size() + int64(len(key))
+	if size > m.maxBytes {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if element, ok := m.entries[key]; ok {
+		m.removeElement(element)
+	}
+	m.entries[key] = m.order.PushFront(&memoryCacheItem{key: key, response: response, size: size})
+	m.bytes += size
+	for _, tag := range response.Tags {
+		if m.tags[tag] == nil {
+			m.tags[tag] = make(map[string]struct{})
+		}
+		m.tags[tag][key] = struct{}{}
+	}
+	for m.bytes > m.maxBytes {
+		m.removeElement(m.order.Back())
+	}
+	return nil
+}
+
+func (m *MemoryCacheStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[key]; ok {
+		m.removeElement(element)
+	}
+	return nil
+}
+
+func (m *MemoryCacheStore) Purge(tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.tags[tag] {
+		if element, ok := m.entries[key]; ok {
+			m.removeElement(element)
+		}
+	}
+	delete(m.tags, tag)
+	return nil
+}
+
+// Len returns the number of responses held, including expired ones not yet removed
+func (m *MemoryCacheStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// Cleanup removes responses past their retention and returns how many were removed
+func (m *MemoryCacheStore) Cleanup() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	now := time.Now()
+	for element := m.order.Back(); element != nil; {
+		previous := element.Prev()
+		if now.After(element.Value.(*memoryCacheItem).response.RetainUntil()) {
+			m.removeElement(element)
+			removed++
+		}
+		element = previous
+	}
+	return removed, nil
+}
+
+func (m *MemoryCacheStore) removeElement(element *list.Element) {
+	item := element.Value.(*memoryCacheItem)
+	m.order.Remove(element)
+	delete(m.entries, item.key)
+	m.bytes -= item.size
+	for _, tag := range item.response.Tags {
+		if keys := m.tags[tag]; keys != nil {
+			delete(keys, item.key)
+			if len(keys) == 0 {
+				delete(m.tags, tag)
+			}
+		}
+	}
+}
+
+// FileCacheStore keeps one JSON file per response in a directory, so the cache
+// survives restarts and can grow beyond memory. Tags are indexed in a tags subdirectory.
+type FileCacheStore struct {
+	dir string
+	// mu serialises replacing and removing responses and tag index updates
+	mu sync.Mutex
+}
+
+// staleTempAge is how old a temporary file must be for Cleanup to assume its write failed
+const staleTempAge = 10 * time.Minute
+
+// NewFileCacheStore creates the directory if needed and returns a store backed by it
+func NewFileCacheStore(dir string) (*FileCacheStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tags"), 0o700); err != nil {
+		return nil, err
+	}
+	return &FileCacheStore{dir: dir}, nil
+}
+
+func (f *FileCacheStore) Get(key string) (*CachedResponse, error) {
+	response, err := f.read(f.path(key))
+	if err != nil || response == nil {
+		return nil, err
+	}
+	if time.Now().After(response.RetainUntil()) {
+		f.removeExpired(f.path(key), time.Now())
+		return nil, nil
+	}
+	return response, nil
+}
+
+func (f *FileCacheStore) Set(key string, response *CachedResponse) error {
+	content, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that readers never see a partial response
+	tmp, err := os.CreateTemp(f.dir, ".cache-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.Rename(tmp.Name(), f.path(key)); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	for _, tag := range response.Tags {
+		if err := appendLine(f.tagPath(tag), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileCacheStore) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.remove(key)
+}
+
+// remove deletes the response of key and drops it from the indexes of its tags.
+// f.mu must be held.
+func (f *FileCacheStore) remove(key string) error {
+	response, _ := f.read(f.path(key))
+	err := os.Remove(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil || response == nil {
+		return err
+	}
+	for _, tag := range response.Tags {
+		if err := f.unindex(f.tagPath(tag), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindex drops key from the tag index at path. f.mu must be held.
+func (f *FileCacheStore) unindex(path, key string) error {
+	keys, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	kept := slices.DeleteFunc(keys, func(k string) bool { return k == key })
+	if len(kept) == len(keys) {
+		return nil
+	}
+	return writeLines(path, kept)
+}
+
+// Purge removes the responses listed in the tag's index that still carry the tag
+func (f *FileCacheStore) Purge(tag string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys, err := readLines(f.tagPath(tag))
+	if err != nil {
+		return err
+	}
+	// The index goes first, so removing the responses does not rewrite it for each key
+	if err := os.Remove(f.tagPath(tag)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, key := range keys {
+		// The key may have been stored again since, without this tag
+		if response, err := f.read(f.path(key)); err == nil && response != nil && response.hasTag(tag) {
+			if err := f.remove(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Cleanup removes responses past their retention and returns how many were removed.
+// Temporary files left behind by failed writes are removed as well.
+func (f *FileCacheStore) Cleanup() (int, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	now := time.Now()
+	for _, entry := range entries {
+		path := filepath.Join(f.dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), ".cache-") {
+			removeStaleTemp(entry, path, now)
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		if f.removeExpired(path, now) {
+			removed++
+		}
+	}
+	return removed, f.compactTags()
+}
+
+// removeExpired removes the response at path if it is past its retention or unreadable.
+// The lock keeps a concurrent Set of the same key from being removed instead.
+func (f *FileCacheStore) removeExpired(path string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	response, err := f.read(path)
+	if err != nil || (response != nil && now.After(response.RetainUntil())) {
+		return os.Remove(path) == nil
+	}
+	return false
+}
+
+// removeStaleTemp removes a temporary file whose write was abandoned long ago
+func removeStaleTemp(entry fs.DirEntry, path string, now time.Time) {
+	if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) > staleTempAge {
+		_ = os.Remove(path)
+	}
+}
+
+// compactTags rewrites the tag indexes without duplicates and without keys whose
+// response is gone or no longer carries the tag
+func (f *FileCacheStore) compactTags() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(f.dir, "tags"))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		path := filepath.Join(f.dir, "tags", entry.Name())
+		if strings.HasPrefix(entry.Name(), ".tag-") {
+			removeStaleTemp(entry, path, now)
+			continue
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		keys, err := readLines(path)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool, len(keys))
+		kept := keys[:0]
+		for _, key := range keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			response, err := f.read(f.path(key))
+			if err != nil || response == nil || now.After(response.RetainUntil()) {
+				continue
+			}
+			// Index files are named by tag hash, so the tag is matched the same way
+			if slices.ContainsFunc(response.Tags, func(tag string) bool { return f.tagPath(tag) == path }) {
+				kept = append(kept, key)
+			}
+		}
+		if len(kept) < len(keys) {
+			if err := writeLines(path, kept); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FileCacheStore) read(path string) (*CachedResponse, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var response CachedResponse
+	if err := json.Unmarshal(content, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// path hashes the key so that request URLs can never escape the directory
+func (f *FileCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (f *FileCacheStore) tagPath(tag string) string {
+	sum := sha256.Sum256([]byte(tag))
+	return filepath.Join(f.dir, "tags", hex.EncodeToString(sum[:]))
+}
+
+// readLines returns the non-empty lines of the file at path, none when it does not exist
+func readLines(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// writeLines replaces the file at path with lines, removing it when there are none
+func writeLines(path string, lines []string) error {
+	if len(lines) == 0 {
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tag-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func appendLine(path, line string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// TieredCacheStore puts a fast store, usually memory, in front of a larger one
+// such as a FileCacheStore. Hits in the back store are promoted to the front.
+type TieredCacheStore struct {
+	front CacheStore
+	back  CacheStore
+}
+
+// NewTieredCacheStore combines front and back into one store
+func NewTieredCacheStore(front, back CacheStore) *TieredCacheStore {
+	return &TieredCacheStore{front: front, back: back}
+}
+
+func (t *TieredCacheStore) Get(key string) (*CachedResponse, error) {
+	response, err := t.front.Get(key)
+	if err != nil || response != nil {
+		return response, err
+	}
+	response, err = t.back.Get(key)
+	if err != nil || response == nil {
+		return nil, err
+	}
+	return response, t.front.Set(key, response)
+}
+
+func (t *TieredCacheStore) Set(key string, response *CachedResponse) error {
+	if err := t.front.Set(key, response); err != nil {
+		return err
+	}
+	return t.back.Set(key, response)
+}
+
+func (t *TieredCacheStore) Delete(key string) error {
+	return errors.Join(t.front.Delete(key), t.back.Delete(key))
+}
+
+func (t *TieredCacheStore) Purge(tag string) error {
+	return errors.Join(t.front.Purge(tag), t.back.Purge(tag))
+}
+
+// Cleanup cleans both tiers when they support it
+func (t *TieredCacheStore) Cleanup() (int, error) {
+	removed := 0
+	var errs []error
+	for _, store := range []CacheStore{t.front, t.back} {
+		if cleaner, ok := store.(cacheCleaner); ok {
+			n, err := cleaner.Cleanup()
+			removed += n
+			errs = append(errs, err)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// cacheCleaner is implemented by stores that need expired responses removed periodically
+type cacheCleaner interface {
+	Cleanup() (int, error)
+}
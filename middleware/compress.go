@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fasthttp"
+)
+
+// CompressionConfig configures CompressionMiddleware. Zero values fall back to the defaults.
+type CompressionConfig struct {
+	// Encodings lists the offered encodings by preference, "br", "zstd" and "gzip" by default.
+	// The client's q-values win, the order only breaks ties.
+	Encodings []string
+	// MinSize leaves smaller bodies uncompressed, 1024 bytes by default
+	MinSize int
+	// GzipLevel, BrotliLevel and ZstdLevel take the fasthttp Compress* levels, zero picks the default.
+	// Levels the encoders do not support make CompressionMiddleware panic.
+	GzipLevel   int
+	BrotliLevel int
+	ZstdLevel   int
+	// SkipTypes adds content type prefixes that are never compressed
+	SkipTypes []string
+}
+
+// incompressibleTypes are content types that are already compressed
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+}
+
+// CompressionMiddleware compresses response bodies with the best encoding the client accepts.
+// Bodies streamed with ctx.SetBodyStreamWriter are compressed as they are written and flushed
+// whenever the handler flushes, so server-sent events keep working.
+func CompressionMiddleware(config CompressionConfig) *closure.Middleware {
+	if len(config.Encodings) == 0 {
+		config.Encodings = []string{"br", "zstd", "gzip"}
+	}
+	if config.MinSize <= 0 {
+		config.MinSize = 1024
+	}
+	if config.GzipLevel == 0 {
+		config.GzipLevel = fasthttp.CompressDefaultCompression
+	}
+	if config.BrotliLevel == 0 {
+		config.BrotliLevel = fasthttp.CompressBrotliDefaultCompression
+	}
+	if config.ZstdLevel == 0 {
+		config.ZstdLevel = fasthttp.CompressZstdDefault
+	}
+	config.SkipTypes = append(append([]string(nil), incompressibleTypes...), config.SkipTypes...)
+	// Invalid levels fail here, so creating a stream compressor later can not fail
+	for _, encoding := range config.Encodings {
+		compressor, err := newStreamCompressor(io.Discard, encoding, config)
+		if err != nil {
+			panic("middleware: invalid CompressionConfig level for " + encoding + ": " + err.Error())
+		}
+		_ = compressor.Close()
+	}
+
+	return &closure.Middleware{
+		Name: "Compression",
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				if err := next(ctx); err != nil {
+					return err
+				}
+				compressResponse(ctx, config)
+				return nil
+			}
+		},
+	}
+}
+
+func compressResponse(ctx *closure.Context, config CompressionConfig) {
+	status := ctx.Response.StatusCode()
+	if status < 200 || status == fasthttp.StatusNoContent || status == fasthttp.StatusNotModified {
+		return
+	}
+	if len(ctx.Response.Header.ContentEncoding()) > 0 {
+		return
+	}
+	if strings.Contains(string(ctx.Response.Header.Peek("Cache-Control")), "no-transform") {
+		return
+	}
+	if !compressibleType(string(ctx.Response.Header.ContentType()), config.SkipTypes) {
+		return
+	}
+
+	// The response differs by Accept-Encoding even when this client gets it uncompressed
+	addVary(ctx, "Accept-Encoding")
+	if ctx.IsHead() {
+		return
+	}
+	encoding := negotiateEncoding(string(ctx.Request.Header.Peek("Accept-Encoding")), config.Encodings)
+	if encoding == "" {
+		return
+	}
+
+	if ctx.IsBodyStream() {
+		// Streams set with SetBodyStream, such as files, are sent as they are
+		if ctx.WrapBodyStreamWriter(func(sw fasthttp.StreamWriter) fasthttp.StreamWriter {
+			return compressStream(sw, encoding, config)
+		}) {
+			setContentEncoding(ctx, encoding)
+		}
+		return
+	}
+
+	body := ctx.Response.Body()
+	if len(body) < config.MinSize {
+		return
+	}
+	var compressed []byte
+	switch encoding {
+	case "br":
+		compressed = fasthttp.AppendBrotliBytesLevel(nil, body, config.BrotliLevel)
+	case "zstd":
+		compressed = fasthttp.AppendZstdBytesLevel(nil, body, config.ZstdLevel)
+	case "gzip":
+		compressed = fasthttp.AppendGzipBytesLevel(nil, body, config.GzipLevel)
+	default:
+		return
+	}
+	if len(compressed) >= len(body) {
+		return
+	}
+	ctx.Response.SetBodyRaw(compressed)
+	setContentEncoding(ctx, encoding)
+}
+
+// setContentEncoding marks the body as encoded. A strong ETag no longer matches
+// the bytes sent, so it is weakened like most proxies do.
+func setContentEncoding(ctx *closure.Context, encoding string) {
+	ctx.Response.Header.SetContentEncoding(encoding)
+	if etag := string(ctx.Response.Header.Peek("ETag")); etag != "" && !strings.HasPrefix(etag, "W/") {
+		ctx.Response.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// negotiateEncoding picks the offered encoding with the highest q-value in the
+// Accept-Encoding header, or "" when the client accepts none of them
+func negotiateEncoding(header string, offered []string) string {
+	if header == "" {
+		return ""
+	}
+
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := accepted[encoding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func compressibleType(contentType string, skip []string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "image/svg+xml") {
+		return true
+	}
+	for _, prefix := range skip {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// addVary appends field to the Vary header unless it is already listed
+func addVary(ctx *closure.Context, field string) {
+	for _, vary := range ctx.Response.Header.PeekAll("Vary") {
+		for _, listed := range bytes.Split(vary, []byte(",")) {
+			listed = bytes.TrimSpace(listed)
+			if bytes.EqualFold(listed, []byte(field)) || bytes.Equal(listed, []byte("*")) {
+				return
+			}
+		}
+	}
+	ctx.Response.Header.Add("Vary", field)
+}
+
+// streamCompressor is implemented by the gzip, brotli and zstd writers
+type streamCompressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newStreamCompressor(w io.Writer, encoding string, config CompressionConfig) (streamCompressor, error) {
+	switch encoding {
+	case "br":
+		return brotli.NewWriterLevel(w, config.BrotliLevel), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevel(config.ZstdLevel)))
+	default:
+		return gzip.NewWriterLevel(w, config.GzipLevel)
+	}
+}
+
+// compressStream runs sw against a writer that compresses into the response.
+// Every flush by sw flushes the compressor and the connection. The compressor is
+// only created when the stream runs, so a stream that never runs holds no encoder.
+func compressStream(sw fasthttp.StreamWriter, encoding string, config CompressionConfig) fasthttp.StreamWriter {
+	return func(w *bufio.Writer) {
+		compressor, err := newStreamCompressor(w, encoding, config)
+		if err != nil {
+			logging.Error("stream compressor failed: %s", err.Error())
+			return
+		}
+		body := bufio.NewWriterSize(&flushingWriter{compressor: compressor, w: w}, 32*1024)
+		sw(body)
+		// Close releases the encoder even when the client is gone
+		err = body.Flush()
+		if closeErr := compressor.Close(); err == nil && closeErr == nil {
+			_ = w.Flush()
+		}
+	}
+}
+
+// flushingWriter pushes every write through the compressor to the client
+type flushingWriter struct {
+	compressor streamCompressor
+	w          *bufio.Writer
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.compressor.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := f.compressor.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
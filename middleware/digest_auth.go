@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/valyala/fasthttp"
+)
+
+// DigestAuthConfig configures DigestAuthMiddleware. Zero values fall back to the defaults.
+type DigestAuthConfig struct {
+	// Lookup finds the password of a user and is required
+	Lookup UserLookup
+	// Realm is part of the password hash and shown in the login prompt, "Restricted" by default
+	Realm string
+	// Algorithms are offered in order of preference, "SHA-256" and "MD5" by default.
+	// The "-sess" variants are supported as well.
+	Algorithms []string
+	// NonceTTL is how long a nonce is accepted, 5 minutes by default. Clients then
+	// get a stale challenge and retry without asking the user again.
+	NonceTTL time.Duration
+	// Secret signs the nonces and derives the opaque value, random by default.
+	// Instances behind a load balancer need the same secret to accept each other's nonces.
+	Secret []byte
+	// NonceCounts records the nonce counts that were used, to refuse replays. It is a
+	// MemoryRevocationStore by default, which only refuses replays to the same instance,
+	// so instances sharing a Secret should share a store as well.
+	NonceCounts RevocationStore
+}
+
+// DigestAuthMiddleware authenticates requests with HTTP Digest auth (RFC 7616), which
+// proves knowledge of the password without sending it. Nonces are signed rather than
+// stored, only the nonce counts of authenticated clients are kept to refuse replays.
+// Counts may arrive in any order, e.g. from parallel requests, but each only once.
+func DigestAuthMiddleware(config DigestAuthConfig) *closure.Middleware {
+	if config.Lookup == nil {
+		panic("middleware: DigestAuthConfig.Lookup is required")
+	}
+	for _, algorithm := range config.Algorithms {
+		if digestHash(algorithm) == nil {
+			panic("middleware: DigestAuthConfig.Algorithms contains the unsupported algorithm " + strconv.Quote(algorithm))
+		}
+	}
+	if config.Realm == "" {
+		config.Realm = "Restricted"
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = []string{"SHA-256", "MD5"}
+	}
+	if config.NonceTTL <= 0 {
+		config.NonceTTL = 5 * time.Minute
+	}
+	if len(config.Secret) == 0 {
+		config.Secret = make([]byte, 32)
+		_, _ = rand.Read(config.Secret)
+	}
+	if config.NonceCounts == nil {
+		config.NonceCounts = NewMemoryRevocationStore()
+	}
+
+	digest := &digestAuth{config: config}
+	// Derived rather than random, so instances sharing the secret agree on it. The
+	// input is longer than a nonce payload, so the value never signs a nonce.
+	digest.opaque = hex.EncodeToString(digest.sign([]byte("digest auth opaque\x00" + config.Realm)))
+	var sweeper sync.Once
+
+	return &closure.Middleware{
+		Name: "DigestAuth",
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				sweeper.Do(func() {
+					if cleaner, ok := config.NonceCounts.(revocationCleaner); ok {
+						go sweepRevocations(ctx.ServerContext(), cleaner, config.NonceTTL)
+					}
+				})
+
+				user, stale, err := digest.authenticate(ctx, time.Now())
+				if err != nil {
+					logging.Error("digest nonce count store failed: %s", err.Error())
+					return closure.NewHTTPError(fasthttp.StatusServiceUnavailable, "Service Unavailable")
+				}
+				if user == "" {
+					digest.challenge(ctx, stale, time.Now())
+					return closure.NewHTTPError(fasthttp.StatusUnauthorized, "Unauthorized")
+				}
+				authUserKey.Set(ctx, user)
+				return next(ctx)
+			}
+		},
+	}
+}
+
+type digestAuth struct {
+	config DigestAuthConfig
+	opaque string
+}
+
+// challenge sends one WWW-Authenticate header per algorithm, the preferred one first
+func (d *digestAuth) challenge(ctx *closure.Context, stale bool, now time.Time) {
+	nonce := d.newNonce(now)
+	for i, algorithm := range d.config.Algorithms {
+		value := `Digest realm="` + quoteAuthParam(d.config.Realm) + `", qop="auth", algorithm=` + algorithm +
+			`, nonce="` + nonce + `", opaque="` + d.opaque + `"`
+		if stale {
+			value += ", stale=true"
+		}
+		if i == 0 {
+			ctx.Response.Header.Set("WWW-Authenticate", value)
+		} else {
+			ctx.Response.Header.Add("WWW-Authenticate", value)
+		}
+	}
+}
+
+// authenticate returns the user of a valid Authorization header, or "" and whether
+// the credentials were right but the nonce expired. Errors come from NonceCounts.
+func (d *digestAuth) authenticate(ctx *closure.Context, now time.Time) (string, bool, error) {
+	scheme, rest, ok := strings.Cut(string(ctx.Request.Header.Peek("Authorization")), " ")
+	if !ok || !strings.EqualFold(scheme, "Digest") {
+		return "", false, nil
+	}
+	params := parseAuthParams(rest)
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	newHash := digestHash(algorithm)
+	if newHash == nil || !d.offers(algorithm) {
+		return "", false, nil
+	}
+	user := params["username"]
+	if user == "" || params["realm"] != d.config.Realm || params["opaque"] != d.opaque ||
+		params["qop"] != "auth" || params["uri"] != string(ctx.RequestURI()) || params["cnonce"] == "" {
+		return "", false, nil
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil || nc == 0 {
+		return "", false, nil
+	}
+	issued, valid := d.checkNonce(params["nonce"])
+	if !valid {
+		return "", false, nil
+	}
+
+	password, exists := d.config.Lookup(ctx, user)
+	h := func(parts ...string) string {
+		sum := newHash()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+	ha1 := h(user, d.config.Realm, password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = h(ha1, params["nonce"], params["cnonce"])
+	}
+	ha2 := h(string(ctx.Method()), params["uri"])
+	expected := h(ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 || !exists {
+		return "", false, nil
+	}
+
+	expires := issued.Add(d.config.NonceTTL)
+	if !now.Before(expires) {
+		return "", true, nil
+	}
+	// The count is parsed, so "1" and "00000001" can not be used to replay each other
+	fresh, err := d.config.NonceCounts.Revoke(ctx.Context(), "digest:"+params["nonce"]+":"+strconv.FormatUint(nc, 16), expires)
+	if err != nil || !fresh {
+		return "", false, err
+	}
+	return user, false, nil
+}
+
+func (d *digestAuth) offers(algorithm string) bool {
+	for _, offered := range d.config.Algorithms {
+		if strings.EqualFold(offered, algorithm) {
+			return true
+		}
+	}
+	return false
+}
+
+// newNonce encodes the issue time and a random value, signed so that they can be
+// checked without storing the nonce
+func (d *digestAuth) newNonce(now time.Time) string {
+	payload := make([]byte, 16, 32)
+	binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+	_, _ = rand.Read(payload[8:16])
+	return base64.RawURLEncoding.EncodeToString(append(payload, d.sign(payload)...))
+}
+
+// checkNonce verifies the signature of a nonce and returns when it was issued
+func (d *digestAuth) checkNonce(nonce string) (time.Time, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 32 || !hmac.Equal(raw[16:], d.sign(raw[:16])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(raw))), true
+}
+
+func (d *digestAuth) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, d.config.Secret)
+	mac.Write(payload)
+	return mac.Sum(nil)[:16]
+}
+
+// digestHash returns the hash of a Digest algorithm, or nil when it is not supported
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	default:
+		return nil
+	}
+}
+
+// parseAuthParams parses the comma separated name=value pairs of an Authorization
+// header, where values may be quoted strings with backslash escapes
+func parseAuthParams(header string) map[string]string {
+	params := make(map[string]string)
+	for header != "" {
+		header = strings.TrimLeft(header, " \t,")
+		name, rest, ok := strings.Cut(header, "=")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			header = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			header = rest[end:]
+		}
+		params[name] = value.String()
+	}
+	return params
+}
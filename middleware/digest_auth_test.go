@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	"github.com/valyala/fasthttp"
+)
+
+var digestUsers = map[string]string{"alice": "wonderland"}
+
+func digestRouter(config DigestAuthConfig) *closure.Router {
+	config.Lookup = func(ctx *closure.Context, user string) (string, bool) {
+		password, ok := digestUsers[user]
+		return password, ok
+	}
+	router := closure.NewRouter()
+	cluster := closure.NewCluster("/", router, *DigestAuthMiddleware(config))
+	cluster.Get("/private", func(ctx *closure.Context) error {
+		user, _ := AuthUser(ctx)
+		ctx.SetBodyString(user)
+		return nil
+	})
+	return router
+}
+
+// digestChallenge requests /private without credentials and returns the parameters
+// of the first challenge
+func digestChallenge(t *testing.T, router *closure.Router) map[string]string {
+	t.Helper()
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/private")
+	router.ServeHTTP(&ctx)
+	if status := ctx.Response.StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", status)
+	}
+	_, params, _ := strings.Cut(string(ctx.Response.Header.Peek("WWW-Authenticate")), " ")
+	return parseAuthParams(params)
+}
+
+// digestClient answers challenges the way a browser would
+type digestClient struct {
+	user, password string
+	algorithm      string
+	challenge      map[string]string
+}
+
+func (c *digestClient) authorization(nc int) string {
+	newHash := map[string]func() hash.Hash{"MD5": md5.New, "SHA-256": sha256.New}[strings.TrimSuffix(c.algorithm, "-sess")]
+	h := func(parts ...string) string {
+		sum := newHash()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+	ncValue := fmt.Sprintf("%08x", nc)
+	cnonce := "0a4f113b"
+	ha1 := h(c.user, c.challenge["realm"], c.password)
+	if strings.HasSuffix(c.algorithm, "-sess") {
+		ha1 = h(ha1, c.challenge["nonce"], cnonce)
+	}
+	response := h(ha1, c.challenge["nonce"], ncValue, cnonce, "auth", h("GET", "/private"))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="/private", algorithm=%s, `+
+		`qop=auth, nc=%s, cnonce="%s", response="%s", opaque="%s"`,
+		c.user, c.challenge["realm"], c.challenge["nonce"], c.algorithm, ncValue, cnonce, response, c.challenge["opaque"])
+}
+
+func digestGet(router *closure.Router, authorization string) *fasthttp.Response {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/private")
+	ctx.Request.Header.Set("Authorization", authorization)
+	router.ServeHTTP(&ctx)
+	return &ctx.Response
+}
+
+func TestDigestAuthAlgorithms(t *testing.T) {
+	router := digestRouter(DigestAuthConfig{Algorithms: []string{"SHA-256", "MD5", "SHA-256-sess"}})
+	for _, algorithm := range []string{"SHA-256", "MD5", "SHA-256-sess"} {
+		client := &digestClient{user: "alice", password: "wonderland", algorithm: algorithm, challenge: digestChallenge(t, router)}
+		resp := digestGet(router, client.authorization(1))
+		if status := resp.StatusCode(); status != fasthttp.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", algorithm, status)
+		}
+		if body := string(resp.Body()); body != "alice" {
+			t.Fatalf("%s: user = %q, want alice", algorithm, body)
+		}
+	}
+
+	client := &digestClient{user: "alice", password: "wrong", algorithm: "SHA-256", challenge: digestChallenge(t, router)}
+	if status := digestGet(router, client.authorization(1)).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("wrong password: status = %d, want 401", status)
+	}
+	client = &digestClient{user: "mallory", password: "wonderland", algorithm: "SHA-256", challenge: digestChallenge(t, router)}
+	if status := digestGet(router, client.authorization(1)).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("unknown user: status = %d, want 401", status)
+	}
+}
+
+func TestDigestAuthRejectsUnsupportedAlgorithm(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("DigestAuthMiddleware accepted SHA-512")
+		}
+	}()
+	digestRouter(DigestAuthConfig{Algorithms: []string{"SHA-256", "SHA-512"}})
+}
+
+func TestDigestAuthNonceCounts(t *testing.T) {
+	router := digestRouter(DigestAuthConfig{})
+	client := &digestClient{user: "alice", password: "wonderland", algorithm: "SHA-256", challenge: digestChallenge(t, router)}
+
+	// Parallel requests may arrive out of order, each count is accepted once
+	for _, nc := range []int{1, 3, 2} {
+		if status := digestGet(router, client.authorization(nc)).StatusCode(); status != fasthttp.StatusOK {
+			t.Fatalf("nc %d: status = %d, want 200", nc, status)
+		}
+	}
+	for _, nc := range []int{1, 2, 3} {
+		if status := digestGet(router, client.authorization(nc)).StatusCode(); status != fasthttp.StatusUnauthorized {
+			t.Fatalf("replayed nc %d: status = %d, want 401", nc, status)
+		}
+	}
+}
+
+func TestDigestAuthSharedInstances(t *testing.T) {
+	config := DigestAuthConfig{Secret: []byte("shared secret"), NonceCounts: NewMemoryRevocationStore()}
+	first, second := digestRouter(config), digestRouter(config)
+
+	client := &digestClient{user: "alice", password: "wonderland", algorithm: "SHA-256", challenge: digestChallenge(t, first)}
+	authorization := client.authorization(1)
+	if status := digestGet(second, authorization).StatusCode(); status != fasthttp.StatusOK {
+		t.Fatalf("nonce of another instance: status = %d, want 200", status)
+	}
+	if status := digestGet(first, authorization).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("replay against another instance: status = %d, want 401", status)
+	}
+
+	other := digestRouter(DigestAuthConfig{Secret: []byte("other secret")})
+	if status := digestGet(other, client.authorization(2)).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("nonce signed with another secret: status = %d, want 401", status)
+	}
+}
+
+func TestDigestAuthTamperedNonce(t *testing.T) {
+	router := digestRouter(DigestAuthConfig{})
+	challenge := digestChallenge(t, router)
+	nonce := []byte(challenge["nonce"])
+	nonce[2] ^= 1
+	challenge["nonce"] = string(nonce)
+
+	client := &digestClient{user: "alice", password: "wonderland", algorithm: "SHA-256", challenge: challenge}
+	if status := digestGet(router, client.authorization(1)).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", status)
+	}
+}
+
+func TestDigestAuthStaleNonce(t *testing.T) {
+	router := digestRouter(DigestAuthConfig{NonceTTL: 50 * time.Millisecond})
+	client := &digestClient{user: "alice", password: "wonderland", algorithm: "SHA-256", challenge: digestChallenge(t, router)}
+	time.Sleep(100 * time.Millisecond)
+
+	resp := digestGet(router, client.authorization(1))
+	if status := resp.StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", status)
+	}
+	if challenge := string(resp.Header.Peek("WWW-Authenticate")); !strings.HasSuffix(challenge, "stale=true") {
+		t.Fatalf("challenge %q is not marked stale", challenge)
+	}
+
+	// Wrong credentials with an expired nonce must not learn that the nonce is stale
+	client.password = "wrong"
+	resp = digestGet(router, client.authorization(1))
+	if challenge := string(resp.Header.Peek("WWW-Authenticate")); strings.Contains(challenge, "stale") {
+		t.Fatalf("challenge %q is marked stale for wrong credentials", challenge)
+	}
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	"github.com/valyala/fasthttp"
+)
+
+// ETagConfig configures ETagMiddleware
+type ETagConfig struct {
+	// Weak marks generated ETags as weak, for bodies that are equivalent rather than byte-identical
+	Weak bool
+	// CurrentETag returns the ETag of the resource a PUT, PATCH or DELETE targets, or "" when it
+	// does not exist. Without it handlers check If-Match themselves with ctx.CheckPreconditions.
+	CurrentETag func(ctx *closure.Context) (string, error)
+}
+
+// ETagMiddleware tags successful GET and HEAD responses with an ETag computed from
+// the final body unless the handler set one, and answers matching conditional
+// requests with 304. Unsafe requests failing If-Match get 412.
+func ETagMiddleware(config ETagConfig) *closure.Middleware {
+	return &closure.Middleware{
+		Name: "ETag",
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				if ctx.IsGet() || ctx.IsHead() {
+					if err := next(ctx); err != nil {
+						return err
+					}
+					tagResponse(ctx, config)
+					return nil
+				}
+
+				if config.CurrentETag != nil && hasPreconditions(ctx) && (ctx.IsPut() || ctx.IsPatch() || ctx.IsDelete()) {
+					etag, err := config.CurrentETag(ctx)
+					if err != nil {
+						return err
+					}
+					if !ctx.CheckPreconditions(etag, time.Time{}) {
+						return nil
+					}
+				}
+				return next(ctx)
+			}
+		},
+	}
+}
+
+func tagResponse(ctx *closure.Context, config ETagConfig) {
+	// Streams are not buffered, so their body is not known here
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || ctx.IsBodyStream() {
+		return
+	}
+
+	etag := string(ctx.Response.Header.Peek("ETag"))
+	if etag == "" {
+		sum := sha256.Sum256(ctx.Response.Body())
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		if config.Weak {
+			etag = "W/" + etag
+		}
+		ctx.Response.Header.Set("ETag", etag)
+	}
+
+	var modTime time.Time
+	if lastModified := ctx.Response.Header.Peek("Last-Modified"); len(lastModified) > 0 {
+		modTime, _ = http.ParseTime(string(lastModified))
+	}
+	ctx.CheckPreconditions(etag, modTime)
+}
+
+func hasPreconditions(ctx *closure.Context) bool {
+	return len(ctx.Request.Header.Peek("If-Match")) > 0 ||
+		len(ctx.Request.Header.Peek("If-None-Match")) > 0 ||
+		len(ctx.Request.Header.Peek("If-Unmodified-Since")) > 0
+}
@@ -0,0 +1,307 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/goccy/go-json"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+)
+
+// JWKSConfig configures a JWKS. Zero values fall back to the defaults.
+type JWKSConfig struct {
+	// URL or File locates the JWKS document, URL wins when both are set.
+	// Symmetric "oct" keys are only read from a File, a document fetched from a URL
+	// is public and its secrets could be used to sign tokens.
+	URL  string
+	File string
+	// RefreshInterval is how often the keys are reloaded, 1 hour by default
+	RefreshInterval time.Duration
+	// MinRefreshInterval limits reloads caused by tokens with an unknown kid, 1 minute by default
+	MinRefreshInterval time.Duration
+	// Timeout bounds fetching the URL, 10 seconds by default
+	Timeout time.Duration
+}
+
+// JWKS resolves JWT verification keys by kid from a JSON Web Key Set, so that keys
+// rotated by the identity provider are picked up without a restart. Set it as
+// JWTConfig.JWKS, or use Keyfunc with any jwt parser.
+type JWKS struct {
+	config JWKSConfig
+
+	mu   sync.RWMutex
+	keys map[string]jwk
+
+	// refreshMu serializes reloads, lastAttempt rate limits the unknown kid ones
+	refreshMu   sync.Mutex
+	lastAttempt time.Time
+	scheduler   sync.Once
+}
+
+// jwk is a parsed key of the set
+type jwk struct {
+	key any
+	alg string
+}
+
+// NewJWKS loads the key set and returns an error when that first load fails
+func NewJWKS(config JWKSConfig) (*JWKS, error) {
+	if config.URL == "" && config.File == "" {
+		return nil, errors.New("jwks: URL or File is required")
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = time.Hour
+	}
+	if config.MinRefreshInterval <= 0 {
+		config.MinRefreshInterval = time.Minute
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	// lastAttempt stays zero, so a key rotated right after startup is picked up at once
+	j := &JWKS{config: config}
+	if err := j.Refresh(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Keyfunc returns the key for the kid of token. An unknown kid triggers a reload,
+// at most once per MinRefreshInterval.
+func (j *JWKS) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := j.lookup(kid)
+	if !ok {
+		j.refreshUnknown(kid)
+		if key, ok = j.lookup(kid); !ok {
+			return nil, fmt.Errorf("jwks: unknown kid %q", kid)
+		}
+	}
+	if key.alg != "" && key.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("jwks: key %q is for %s, not %s", kid, key.alg, token.Method.Alg())
+	}
+	return key.key, nil
+}
+
+// lookup finds the key by kid. Tokens without kid use the only key of a single key set.
+func (j *JWKS) lookup(kid string) (jwk, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+func (j *JWKS) refreshUnknown(kid string) {
+	j.refreshMu.Lock()
+	defer j.refreshMu.Unlock()
+
+	// Another request may have reloaded the set while this one waited
+	if _, ok := j.lookup(kid); ok || time.Since(j.lastAttempt) < j.config.MinRefreshInterval {
+		return
+	}
+	j.lastAttempt = time.Now()
+	if err := j.load(); err != nil {
+		logging.Error("jwks refresh failed: %s", err.Error())
+	}
+}
+
+// Refresh reloads the key set. The previous keys stay in use when it fails.
+func (j *JWKS) Refresh() error {
+	j.refreshMu.Lock()
+	defer j.refreshMu.Unlock()
+	return j.load()
+}
+
+func (j *JWKS) load() error {
+	data, err := j.fetch()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data, j.config.URL == "")
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *JWKS) fetch() ([]byte, error) {
+	if j.config.URL == "" {
+		return os.ReadFile(j.config.File)
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(j.config.URL)
+	req.Header.Set("Accept", "application/json")
+	if err := fasthttp.DoTimeout(req, resp, j.config.Timeout); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("jwks: %s responded %d", j.config.URL, resp.StatusCode())
+	}
+	return append([]byte(nil), resp.Body()...), nil
+}
+
+// start reloads the keys every RefreshInterval until ctx is done. Only the first call starts it.
+func (j *JWKS) start(ctx context.Context) {
+	j.scheduler.Do(func() {
+		go func() {
+			ticker := time.NewTicker(j.config.RefreshInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					if err := j.Refresh(); err != nil {
+						logging.Error("jwks refresh failed: %s", err.Error())
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	})
+}
+
+// jwkDocument is a key of a JWKS document as defined in RFC 7517 and RFC 8037
+type jwkDocument struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// parseJWKS parses the signing keys of a JWKS document. Keys of unsupported
+// types are skipped, as are symmetric keys unless allowSecret is set.
+// Malformed keys fail the whole document.
+func parseJWKS(data []byte, allowSecret bool) (map[string]jwk, error) {
+	var document struct {
+		Keys []jwkDocument `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	keys := make(map[string]jwk, len(document.Keys))
+	for _, doc := range document.Keys {
+		if doc.Use != "" && doc.Use != "sig" {
+			continue
+		}
+		if doc.Kty == "oct" && !allowSecret {
+			logging.Warn("jwks: skipping symmetric key %q of a remote key set", doc.Kid)
+			continue
+		}
+		key, err := doc.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %q: %w", doc.Kid, err)
+		}
+		if key != nil {
+			keys[doc.Kid] = jwk{key: key, alg: doc.Alg}
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the verification key, or nil for an unsupported key type
+func (doc jwkDocument) publicKey() (any, error) {
+	switch doc.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(doc.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URL(doc.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch doc.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeBase64URL(doc.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URL(doc.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+
+	case "OKP":
+		if doc.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := decodeBase64URL(doc.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	case "oct":
+		return decodeBase64URL(doc.K)
+
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
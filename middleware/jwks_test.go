@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwksServer serves a key set that tests can rotate and counts its fetches
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+
+	mu       sync.Mutex
+	keys     []string
+	failing  bool
+	privates map[string]ed25519.PrivateKey
+}
+
+func newJWKSServer(t *testing.T, kids ...string) *jwksServer {
+	t.Helper()
+	s := &jwksServer{privates: make(map[string]ed25519.PrivateKey)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"keys":[` + strings.Join(s.keys, ",") + `]}`))
+	}))
+	t.Cleanup(s.Close)
+	s.rotate(t, kids...)
+	return s
+}
+
+// rotate replaces the served keys with new Ed25519 keys named kids
+func (s *jwksServer) rotate(t *testing.T, kids ...string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = s.keys[:0]
+	for _, kid := range kids {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.privates[kid] = private
+		s.keys = append(s.keys, `{"kty":"OKP","crv":"Ed25519","alg":"EdDSA","kid":"`+kid+`","x":"`+
+			base64.RawURLEncoding.EncodeToString(public)+`"}`)
+	}
+}
+
+func (s *jwksServer) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+// token signs a token with the key named kid
+func (s *jwksServer) token(t *testing.T, kid string) string {
+	t.Helper()
+	s.mu.Lock()
+	private, ok := s.privates[kid]
+	s.mu.Unlock()
+	if !ok {
+		_, private, _ = ed25519.GenerateKey(rand.Reader)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "alice"})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func verifies(jwks *JWKS, token string) bool {
+	parsed, err := jwt.Parse(token, jwks.Keyfunc)
+	return err == nil && parsed.Valid
+}
+
+func TestJWKSCachesKeys(t *testing.T) {
+	server := newJWKSServer(t, "k1", "k2")
+	jwks, err := NewJWKS(JWKSConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kid := range []string{"k1", "k2", "k1", "k2"} {
+		if !verifies(jwks, server.token(t, kid)) {
+			t.Fatalf("token with kid %s was rejected", kid)
+		}
+	}
+	if fetches := server.fetches.Load(); fetches != 1 {
+		t.Fatalf("fetches = %d, want the keys to be cached after the first", fetches)
+	}
+}
+
+func TestJWKSUnknownKidRefreshIsRateLimited(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	jwks, err := NewJWKS(JWKSConfig{URL: server.URL, MinRefreshInterval: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key rotated right after startup is picked up at once
+	server.rotate(t, "k1", "k2")
+	if !verifies(jwks, server.token(t, "k2")) {
+		t.Fatal("k2 was rejected right after startup")
+	}
+	if fetches := server.fetches.Load(); fetches != 2 {
+		t.Fatalf("fetches = %d, want 2", fetches)
+	}
+
+	// A flood of tokens with unknown kids reloads at most once per interval
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			verifies(jwks, server.token(t, "unknown"))
+		}()
+	}
+	wg.Wait()
+	if fetches := server.fetches.Load(); fetches != 2 {
+		t.Fatalf("fetches = %d after unknown kids, want 2", fetches)
+	}
+	time.Sleep(250 * time.Millisecond)
+	verifies(jwks, server.token(t, "unknown"))
+	verifies(jwks, server.token(t, "unknown"))
+	if fetches := server.fetches.Load(); fetches != 3 {
+		t.Fatalf("fetches = %d after the interval, want 3", fetches)
+	}
+}
+
+func TestJWKSScheduledRefresh(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	jwks, err := NewJWKS(JWKSConfig{
+		URL:                server.URL,
+		RefreshInterval:    100 * time.Millisecond,
+		MinRefreshInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jwks.start(ctx)
+	jwks.start(ctx)
+
+	server.rotate(t, "k2")
+	time.Sleep(250 * time.Millisecond)
+	if !verifies(jwks, server.token(t, "k2")) {
+		t.Fatal("rotated key was not picked up by the scheduled refresh")
+	}
+	if verifies(jwks, server.token(t, "k1")) {
+		t.Fatal("removed key is still accepted")
+	}
+	if fetches := server.fetches.Load(); fetches < 2 || fetches > 4 {
+		t.Fatalf("fetches = %d, want one per interval from a single scheduler", fetches)
+	}
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	stopped := server.fetches.Load()
+	time.Sleep(250 * time.Millisecond)
+	if fetches := server.fetches.Load(); fetches != stopped {
+		t.Fatalf("fetches went from %d to %d after the context ended", stopped, fetches)
+	}
+}
+
+func TestJWKSKeepsKeysWhenRefreshFails(t *testing.T) {
+	server := newJWKSServer(t, "k1")
+	jwks, err := NewJWKS(JWKSConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.setFailing(true)
+	if err := jwks.Refresh(); err == nil {
+		t.Fatal("Refresh succeeded against a failing server")
+	}
+	if !verifies(jwks, server.token(t, "k1")) {
+		t.Fatal("keys were dropped after a failed refresh")
+	}
+
+	if _, err := NewJWKS(JWKSConfig{URL: server.URL}); err == nil {
+		t.Fatal("NewJWKS succeeded although the first load failed")
+	}
+}
+
+func TestJWKSSecretKeysOnlyFromFile(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	document := `{"keys":[{"kty":"oct","kid":"hmac","k":"` + base64.RawURLEncoding.EncodeToString(secret) + `"}]}`
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"})
+	token.Header["kid"] = "hmac"
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(document))
+	}))
+	defer server.Close()
+	remote, err := NewJWKS(JWKSConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifies(remote, signed) {
+		t.Fatal("symmetric key from a URL was accepted")
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, []byte(document), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewJWKS(JWKSConfig{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifies(local, signed) {
+		t.Fatal("symmetric key from a file was rejected")
+	}
+}
@@ -1,28 +1,254 @@
 package middleware
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
 	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+)
+
+// JWTClaimsKey holds the claims of the token verified by JWTMiddleware
+var JWTClaimsKey = closure.NewKey[jwt.MapClaims]("jwt_claims")
+
+// JWTConfig configures JWTMiddleware. Zero values fall back to the defaults.
+type JWTConfig struct {
+	// Key verifies the signatures: a []byte or string secret for HS256/384/512, an
+	// *rsa.PublicKey for RS* and PS*, an *ecdsa.PublicKey for ES* or an ed25519.PublicKey for EdDSA
+	Key any
+	// KeyFunc returns the key for a token, e.g. by its kid header. It takes precedence over Key.
+	KeyFunc jwt.Keyfunc
+	// JWKS resolves keys from a rotating key set, its scheduled refresh starts with the
+	// first request. It takes precedence over Key.
+	JWKS *JWKS
+	// Algorithms lists the accepted algorithms, by default those matching the type of Key.
+	// With KeyFunc or JWKS every algorithm is accepted whose key type matches the returned key.
+	Algorithms []string
+	// Issuer, when set, must equal the iss claim
+	Issuer string
+	// Audience, when set, must contain one of the aud values
+	Audience []string
+	// Leeway tolerates clock skew when checking exp, nbf and iat
+	Leeway time.Duration
+	// AllowMissingExpiry accepts tokens without an exp claim
+	AllowMissingExpiry bool
+	// TokenLookup lists where the token is taken from, in order, as "header:<name>",
+	// "cookie:<name>" or "query:<name>". The default is "header:Authorization", which
+	// expects the Bearer scheme.
+	TokenLookup []string
+	// Realm is sent in the WWW-Authenticate header of 401 responses
+	Realm string
+	// TokenType, when set, must equal the typ claim, e.g. "access" for the tokens of
+	// a TokenService. Tokens typed "refresh" are rejected either way.
+	TokenType string
+	// Revocations, when set, rejects tokens whose jti or token family is revoked
+	Revocations RevocationStore
+	// Validate runs further checks on the verified claims, an error rejects the token.
+	// The client only sees a generic description, the error itself is logged.
+	Validate func(claims jwt.MapClaims) error
+}
+
+var (
+	errTokenMissing   = errors.New("token is missing")
+	errTokenExpired   = errors.New("token is expired")
+	errTokenNoExpiry  = errors.New("token has no expiry")
+	errTokenBadExpiry = errors.New("token expiry is not a valid time")
+	errTokenNotYet    = errors.New("token is not valid yet")
+	errTokenIssuedAt  = errors.New("token is issued in the future")
+	errTokenIssuer    = errors.New("token issuer is not accepted")
+	errTokenAudience  = errors.New("token audience is not accepted")
+	errTokenSignature = errors.New("token is malformed or its signature is invalid")
+	errTokenRevoked   = errors.New("token is revoked")
+	errTokenType      = errors.New("token type is not accepted")
+	errTokenRejected  = errors.New("token is not accepted")
 )
 
-func JWTMiddleware(secret string) *closure.Middleware {
-	//manager := swan_lib.NewJWTMiddleware(secret)
+// JWTMiddleware verifies the bearer token of every request and stores its claims under
+// JWTClaimsKey. Requests without a valid token get 401 with a WWW-Authenticate header.
+func JWTMiddleware(config JWTConfig) *closure.Middleware {
+	if secret, ok := config.Key.(string); ok {
+		config.Key = []byte(secret)
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = algorithmsFor(config.Key)
+	}
+	if len(config.TokenLookup) == 0 {
+		config.TokenLookup = []string{"header:Authorization"}
+	}
+	keyFunc := config.KeyFunc
+	if keyFunc == nil && config.JWKS != nil {
+		keyFunc = config.JWKS.Keyfunc
+	}
+	if keyFunc == nil {
+		keyFunc = func(*jwt.Token) (any, error) {
+			return config.Key, nil
+		}
+	}
+	options := []jwt.ParserOption{jwt.WithoutClaimsValidation()}
+	if (config.KeyFunc == nil && config.JWKS == nil) || len(config.Algorithms) > 0 {
+		// A non-nil empty list accepts nothing, e.g. for a Key of unknown type
+		options = append(options, jwt.WithValidMethods(append([]string{}, config.Algorithms...)))
+	}
+	parser := jwt.NewParser(options...)
+
 	return &closure.Middleware{
 		Name: "JWT",
 		Handler: func(next closure.Handler) closure.Handler {
 			return func(ctx *closure.Context) error {
-				//manager.FastAuthorize(func(ctx *closure.Context) {
-				//	err := next(ctx)
-				//	if err != nil {
-				//		return
-				//	}
-				//})(ctx)		//manager.FastAuthorize(func(ctx *closure.Context) {
-				//	err := next(ctx)
-				//	if err != nil {
-				//		return
-				//	}
-				//})(ctx)
-				return nil
+				if config.JWKS != nil {
+					config.JWKS.start(ctx.ServerContext())
+				}
+				raw := lookupToken(ctx, config.TokenLookup)
+				if raw == "" {
+					return unauthorized(ctx, config.Realm, errTokenMissing)
+				}
+
+				claims := jwt.MapClaims{}
+				if _, err := parser.ParseWithClaims(raw, claims, keyFunc); err != nil {
+					return unauthorized(ctx, config.Realm, errTokenSignature)
+				}
+				if err := validateClaims(claims, config, time.Now()); err != nil {
+					return unauthorized(ctx, config.Realm, err)
+				}
+				// Refresh tokens live long and must only ever reach the refresh endpoint
+				if typ, _ := claims["typ"].(string); typ == "refresh" || (config.TokenType != "" && typ != config.TokenType) {
+					return unauthorized(ctx, config.Realm, errTokenType)
+				}
+				if config.Validate != nil {
+					if err := config.Validate(claims); err != nil {
+						logging.Info("token rejected by Validate: %s", err.Error())
+						return unauthorized(ctx, config.Realm, errTokenRejected)
+					}
+				}
+				if config.Revocations != nil {
+					revoked, err := isTokenRevoked(ctx.Context(), config.Revocations, claims)
+					if err != nil {
+						logging.Error("revocation check failed: %s", err.Error())
+						return closure.NewHTTPError(fasthttp.StatusServiceUnavailable, "Service Unavailable")
+					}
+					if revoked {
+						return unauthorized(ctx, config.Realm, errTokenRevoked)
+					}
+				}
+
+				JWTClaimsKey.Set(ctx, claims)
+				return next(ctx)
 			}
 		},
 	}
 }
+
+// algorithmsFor returns the algorithms that verify with a key of this type
+func algorithmsFor(key any) []string {
+	switch key.(type) {
+	case []byte:
+		return []string{"HS256", "HS384", "HS512"}
+	case *rsa.PublicKey:
+		return []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case *ecdsa.PublicKey:
+		return []string{"ES256", "ES384", "ES512"}
+	case ed25519.PublicKey:
+		return []string{"EdDSA"}
+	default:
+		return nil
+	}
+}
+
+// validateClaims checks the registered claims, the signature is already verified
+func validateClaims(claims jwt.MapClaims, config JWTConfig, now time.Time) error {
+	// exp is checked here rather than with VerifyExpiresAt, which accepts 0 as no expiry
+	if value, ok := claims["exp"]; ok {
+		exp, valid := numericDate(value)
+		if !valid || exp <= 0 {
+			return errTokenBadExpiry
+		}
+		if float64(now.Add(-config.Leeway).Unix()) >= exp {
+			return errTokenExpired
+		}
+	} else if !config.AllowMissingExpiry {
+		return errTokenNoExpiry
+	}
+	if !claims.VerifyNotBefore(now.Add(config.Leeway).Unix(), false) {
+		return errTokenNotYet
+	}
+	if !claims.VerifyIssuedAt(now.Add(config.Leeway).Unix(), false) {
+		return errTokenIssuedAt
+	}
+	if config.Issuer != "" && !claims.VerifyIssuer(config.Issuer, true) {
+		return errTokenIssuer
+	}
+	if len(config.Audience) > 0 {
+		for _, audience := range config.Audience {
+			if claims.VerifyAudience(audience, true) {
+				return nil
+			}
+		}
+		return errTokenAudience
+	}
+	return nil
+}
+
+// numericDate reads a NumericDate claim, seconds since the epoch as a JSON number
+func numericDate(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// lookupToken returns the first token found in the configured places
+func lookupToken(ctx *closure.Context, lookup []string) string {
+	for _, source := range lookup {
+		kind, name, _ := strings.Cut(source, ":")
+		var value string
+		switch kind {
+		case "header":
+			value = string(ctx.Request.Header.Peek(name))
+			if strings.EqualFold(name, "Authorization") {
+				scheme, token, ok := strings.Cut(value, " ")
+				if !ok || !strings.EqualFold(scheme, "Bearer") {
+					continue
+				}
+				value = token
+			}
+		case "cookie":
+			value = string(ctx.Request.Header.Cookie(name))
+		case "query":
+			value = string(ctx.QueryArgs().Peek(name))
+		}
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// unauthorized answers 401 with a Bearer challenge as described in RFC 6750
+func unauthorized(ctx *closure.Context, realm string, reason error) error {
+	var challenge []string
+	if realm != "" {
+		challenge = append(challenge, `realm="`+quoteAuthParam(realm)+`"`)
+	}
+	if reason != errTokenMissing {
+		challenge = append(challenge, `error="invalid_token"`, `error_description="`+quoteAuthParam(reason.Error())+`"`)
+	}
+	header := "Bearer"
+	if len(challenge) > 0 {
+		header += " " + strings.Join(challenge, ", ")
+	}
+	ctx.Response.Header.Set("WWW-Authenticate", header)
+	return closure.NewHTTPError(fasthttp.StatusUnauthorized, reason.Error())
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+)
+
+// RateKeyFunc derives the key RateLimitMiddleware counts a request under, or "" when the
+// request has none. Keys carry a prefix per extractor so that, e.g., a header value
+// cannot share a quota with an IP address.
+type RateKeyFunc func(ctx *closure.Context) string
+
+// KeyByIP counts requests per connecting IP address
+func KeyByIP(ctx *closure.Context) string {
+	return "ip:" + ctx.RemoteIP().String()
+}
+
+// KeyByForwardedIP counts requests per client IP as reported in X-Forwarded-For by
+// trustedProxies proxies in front of the server. Entries further left are set by the
+// client and ignored. Requests that did not pass through all the proxies have no key.
+func KeyByForwardedIP(trustedProxies int) RateKeyFunc {
+	return func(ctx *closure.Context) string {
+		var hops []string
+		for _, header := range ctx.Request.Header.PeekAll("X-Forwarded-For") {
+			for _, hop := range strings.Split(string(header), ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		if trustedProxies <= 0 || len(hops) < trustedProxies || hops[len(hops)-trustedProxies] == "" {
+			return ""
+		}
+		return "ip:" + hops[len(hops)-trustedProxies]
+	}
+}
+
+// KeyByHeader counts requests per value of the named request header
+func KeyByHeader(name string) RateKeyFunc {
+	return func(ctx *closure.Context) string {
+		value := ctx.Request.Header.Peek(name)
+		if len(value) == 0 {
+			return ""
+		}
+		return name + ":" + string(value)
+	}
+}
+
+// KeyByAPIKey counts requests per API key sent in header, X-API-Key by default.
+// The key is hashed so the limiter does not keep secrets in memory.
+func KeyByAPIKey(header string) RateKeyFunc {
+	if header == "" {
+		header = "X-API-Key"
+	}
+	return func(ctx *closure.Context) string {
+		value := ctx.Request.Header.Peek(header)
+		if len(value) == 0 {
+			return ""
+		}
+		sum := sha256.Sum256(value)
+		return "api:" + hex.EncodeToString(sum[:16])
+	}
+}
+
+// KeyByJWTSubject counts requests per subject of the token verified by JWTMiddleware,
+// so the limiter belongs behind it
+func KeyByJWTSubject(ctx *closure.Context) string {
+	claims, ok := JWTClaimsKey.Get(ctx)
+	if !ok {
+		return ""
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return ""
+	}
+	return "sub:" + subject
+}
+
+// KeyByRoute counts requests per method and route pattern, so that every route of a
+// cluster gets its own quota. Combine it with a client key to limit clients per route.
+func KeyByRoute(ctx *closure.Context) string {
+	return "route:" + string(ctx.Method()) + " " + ctx.Route()
+}
+
+// KeyByAll combines the keys of all extractors, it has no key if any of them has none
+func KeyByAll(keys ...RateKeyFunc) RateKeyFunc {
+	return func(ctx *closure.Context) string {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			if parts[i] = key(ctx); parts[i] == "" {
+				return ""
+			}
+		}
+		return strings.Join(parts, "|")
+	}
+}
+
+// KeyByFirst uses the first extractor with a key, e.g. the API key and otherwise the IP
+func KeyByFirst(keys ...RateKeyFunc) RateKeyFunc {
+	return func(ctx *closure.Context) string {
+		for _, key := range keys {
+			if value := key(ctx); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+}
@@ -1,43 +1,360 @@
 package middleware
 
 import (
-	"errors"
+	"context"
+	"hash/maphash"
+	"math"
+	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/valyala/fasthttp"
 )
 
-type rateCounter struct {
-	count     int32
-	lastReset int64
+// RateAlgorithm selects how RateLimitMiddleware counts requests
+type RateAlgorithm int
+
+const (
+	// TokenBucket refills Limit tokens per Window and allows bursts up to Burst
+	TokenBucket RateAlgorithm = iota
+	// SlidingWindow allows at most Limit requests in any Window, remembering each request
+	SlidingWindow
+)
+
+// RateLimitConfig configures RateLimitMiddleware. Zero values fall back to the defaults.
+type RateLimitConfig struct {
+	// Limit is the number of requests allowed per Window, 100 by default
+	Limit int
+	// Window is 1 minute by default
+	Window time.Duration
+	// Algorithm is TokenBucket by default
+	Algorithm RateAlgorithm
+	// Burst is the token bucket capacity, Limit by default
+	Burst int
+	// IdleTimeout forgets clients without requests for this long. The default is
+	// long enough that a forgotten client has its full quota back anyway.
+	IdleTimeout time.Duration
+	// Key derives the key requests are counted under, KeyByIP by default.
+	// Requests it returns "" for are counted by IP.
+	Key RateKeyFunc
+	// Tiers gives named groups of keys their own quota, TierOf picks the tier of a request.
+	// Keys without a known tier get Limit, Window and Burst.
+	Tiers  map[string]RateTier
+	TierOf func(ctx *closure.Context, key string) string
+	// Store shares the counts between instances. Requests are then counted in fixed
+	// windows that start with the first request of a key, so a client may send up to
+	// twice Limit around a window boundary. SlidingWindow and Burst are not supported
+	// with a Store and make RateLimitMiddleware panic.
+	Store RateStore
+	// Name namespaces the keys of this limiter in Store, so limiters sharing a store
+	// keep separate counts. It is required with a Store and must be the same on every
+	// instance that should share the counts, e.g. "login" or "api".
+	Name string
+	// OnStoreError is FailOpen by default
+	OnStoreError RateFailPolicy
+}
+
+// RateTier overrides the quota for the keys in it. Zero values fall back to the RateLimitConfig.
+type RateTier struct {
+	Limit  int
+	Window time.Duration
+	Burst  int
 }
 
-var rateMap sync.Map
+// RateLimitMiddleware limits each key, the client IP by default. Every response carries
+// the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, rejected requests
+// get 429 with Retry-After. Each call creates an independent limiter, so it can be added
+// to single routes or to a whole cluster with Use.
+func RateLimitMiddleware(config RateLimitConfig) *closure.Middleware {
+	if config.Limit <= 0 {
+		config.Limit = 100
+	}
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+	if config.Key == nil {
+		config.Key = KeyByIP
+	}
+	if config.Store != nil {
+		if config.Name == "" {
+			panic("middleware: RateLimitConfig.Name is required with a Store")
+		}
+		if config.Algorithm == SlidingWindow {
+			panic("middleware: RateLimitConfig.Store counts fixed windows and does not support SlidingWindow")
+		}
+		if config.Burst > 0 {
+			panic("middleware: RateLimitConfig.Store counts fixed windows and does not support Burst")
+		}
+		for _, tier := range config.Tiers {
+			if tier.Burst > 0 {
+				panic("middleware: RateLimitConfig.Store counts fixed windows and does not support RateTier.Burst")
+			}
+		}
+	}
+	limiter := newRateLimiter("", withRateDefaults(config, config.IdleTimeout))
+
+	tiers := make(map[string]*rateLimiter, len(config.Tiers))
+	for name, tier := range config.Tiers {
+		tierConfig := config
+		if tier.Limit > 0 {
+			tierConfig.Limit = tier.Limit
+			tierConfig.Burst = 0
+		}
+		if tier.Window > 0 {
+			tierConfig.Window = tier.Window
+		}
+		if tier.Burst > 0 {
+			tierConfig.Burst = tier.Burst
+		}
+		tiers[name] = newRateLimiter(name, withRateDefaults(tierConfig, config.IdleTimeout))
+	}
+	var sweeper sync.Once
 
-func RateLimitMiddleware(limit int, window time.Duration) *closure.Middleware {
 	return &closure.Middleware{
 		Name: "RateLimit",
 		Handler: func(next closure.Handler) closure.Handler {
 			return func(ctx *closure.Context) error {
-				ip := ctx.RemoteIP().String()
-
-				val, _ := rateMap.LoadOrStore(ip, &rateCounter{})
-				counter := val.(*rateCounter)
+				sweeper.Do(func() {
+					go limiter.sweep(ctx.ServerContext())
+					for _, tier := range tiers {
+						go tier.sweep(ctx.ServerContext())
+					}
+					if cleaner, ok := config.Store.(rateCleaner); ok {
+						go sweepRateStore(ctx.ServerContext(), cleaner, config.Window)
+					}
+				})
 
-				now := time.Now().UnixNano()
-				resetTime := atomic.LoadInt64(&counter.lastReset)
-				if now-resetTime > window.Nanoseconds() {
-					atomic.StoreInt32(&counter.count, 0)
-					atomic.StoreInt64(&counter.lastReset, now)
+				key := config.Key(ctx)
+				if key == "" {
+					key = KeyByIP(ctx)
 				}
-				if atomic.AddInt32(&counter.count, 1) > int32(limit) {
-					return errors.New("too many requests")
+				active := limiter
+				if config.TierOf != nil {
+					if tier, ok := tiers[config.TierOf(ctx, key)]; ok {
+						active = tier
+					}
 				}
 
+				result, err := active.allow(ctx.Context(), key, time.Now())
+				if err != nil {
+					logging.Error("rate limit store failed: %s", err.Error())
+					if config.OnStoreError == FailClosed {
+						return closure.NewHTTPError(fasthttp.StatusServiceUnavailable, "Service Unavailable")
+					}
+					return next(ctx)
+				}
+				setRateLimitHeaders(ctx, result)
+				if !result.allowed {
+					ctx.Response.Header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.retryAfter)))
+					return closure.NewHTTPError(fasthttp.StatusTooManyRequests, "Too Many Requests")
+				}
 				return next(ctx)
 			}
 		},
 	}
 }
+
+// withRateDefaults fills in Burst and, unless set for all tiers, IdleTimeout
+func withRateDefaults(config RateLimitConfig, idleTimeout time.Duration) RateLimitConfig {
+	if config.Burst <= 0 {
+		config.Burst = config.Limit
+	}
+	config.IdleTimeout = idleTimeout
+	if config.IdleTimeout <= 0 {
+		// A token bucket refills in Window * Burst / Limit
+		config.IdleTimeout = config.Window * time.Duration((config.Burst+config.Limit-1)/config.Limit)
+	}
+	return config
+}
+
+// rateResult is the outcome of one request against a limit
+type rateResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset is when the client is back to its full quota
+	reset time.Duration
+	// retryAfter is when the next request would be allowed
+	retryAfter time.Duration
+}
+
+func setRateLimitHeaders(ctx *closure.Context, result rateResult) {
+	ctx.Response.Header.Set("RateLimit-Limit", strconv.Itoa(result.limit))
+	ctx.Response.Header.Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	ctx.Response.Header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+const rateShards = 32
+
+// rateLimiter keeps per-key state in shards so that clients rarely contend on one lock
+type rateLimiter struct {
+	// prefix namespaces the keys in a shared store by limiter and tier
+	prefix string
+	config RateLimitConfig
+	seed   maphash.Seed
+	shards [rateShards]rateShard
+}
+
+type rateShard struct {
+	mu      sync.Mutex
+	clients map[string]*rateState
+}
+
+// rateState holds either a token bucket or a sliding log
+type rateState struct {
+	lastSeen time.Time
+	// token bucket
+	tokens float64
+	// sliding window log, oldest first
+	log []time.Time
+}
+
+func newRateLimiter(tier string, config RateLimitConfig) *rateLimiter {
+	limiter := &rateLimiter{prefix: config.Name + "/" + tier + "/", config: config, seed: maphash.MakeSeed()}
+	for i := range limiter.shards {
+		limiter.shards[i].clients = make(map[string]*rateState)
+	}
+	return limiter
+}
+
+func (l *rateLimiter) allow(ctx context.Context, key string, now time.Time) (rateResult, error) {
+	if l.config.Store != nil {
+		return l.allowStore(ctx, key)
+	}
+
+	shard := &l.shards[maphash.String(l.seed, key)%rateShards]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	state, ok := shard.clients[key]
+	if !ok {
+		state = &rateState{tokens: float64(l.config.Burst), lastSeen: now}
+		shard.clients[key] = state
+	}
+
+	if l.config.Algorithm == SlidingWindow {
+		return l.allowSliding(state, now), nil
+	}
+	return l.allowToken(state, now), nil
+}
+
+func (l *rateLimiter) allowStore(ctx context.Context, key string) (rateResult, error) {
+	count, ttl, err := l.config.Store.Increment(ctx, l.prefix+key, l.config.Window)
+	if err != nil {
+		return rateResult{}, err
+	}
+
+	result := rateResult{limit: l.config.Limit, reset: ttl}
+	result.allowed = count <= int64(l.config.Limit)
+	result.remaining = int(max(int64(l.config.Limit)-count, 0))
+	if !result.allowed {
+		result.retryAfter = ttl
+	}
+	return result, nil
+}
+
+func (l *rateLimiter) allowToken(state *rateState, now time.Time) rateResult {
+	perSecond := float64(l.config.Limit) / l.config.Window.Seconds()
+	capacity := float64(l.config.Burst)
+
+	state.tokens = math.Min(capacity, state.tokens+now.Sub(state.lastSeen).Seconds()*perSecond)
+	state.lastSeen = now
+
+	result := rateResult{limit: l.config.Burst}
+	if state.tokens >= 1 {
+		state.tokens--
+		result.allowed = true
+	} else {
+		result.retryAfter = secondsDuration((1 - state.tokens) / perSecond)
+	}
+	result.remaining = int(state.tokens)
+	result.reset = secondsDuration((capacity - state.tokens) / perSecond)
+	return result
+}
+
+func (l *rateLimiter) allowSliding(state *rateState, now time.Time) rateResult {
+	windowStart := now.Add(-l.config.Window)
+	expired := 0
+	for expired < len(state.log) && !state.log[expired].After(windowStart) {
+		expired++
+	}
+	state.log = append(state.log[:0], state.log[expired:]...)
+	state.lastSeen = now
+
+	result := rateResult{limit: l.config.Limit}
+	if len(state.log) < l.config.Limit {
+		state.log = append(state.log, now)
+		result.allowed = true
+	}
+	result.remaining = l.config.Limit - len(state.log)
+	if len(state.log) > 0 {
+		// The quota is full again once the newest request leaves the window,
+		// a slot frees up when the oldest one does
+		result.reset = state.log[len(state.log)-1].Add(l.config.Window).Sub(now)
+		if !result.allowed {
+			result.retryAfter = state.log[0].Add(l.config.Window).Sub(now)
+		}
+	}
+	return result
+}
+
+// sweep forgets idle clients until ctx is done
+func (l *rateLimiter) sweep(ctx context.Context) {
+	if l.config.Store != nil {
+		return
+	}
+	ticker := time.NewTicker(l.config.IdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			l.evictIdle(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *rateLimiter) evictIdle(now time.Time) {
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for key, state := range shard.clients {
+			if now.Sub(state.lastSeen) > l.config.IdleTimeout {
+				delete(shard.clients, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// sweepRateStore removes expired counters every interval until ctx is done
+func sweepRateStore(ctx context.Context, cleaner rateCleaner, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := cleaner.Cleanup(); err != nil {
+				logging.Error("rate limit store cleanup failed: %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
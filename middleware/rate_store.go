@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateStore counts requests for RateLimitMiddleware so that several instances can share
+// their limits. Implementations must be safe for concurrent use.
+type RateStore interface {
+	// Increment atomically adds one to the counter of key and returns the new count and
+	// the time until the counter expires. A counter that does not exist yet starts at
+	// zero and expires after window.
+	Increment(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error)
+}
+
+// RateFailPolicy decides what RateLimitMiddleware does when its RateStore fails
+type RateFailPolicy int
+
+const (
+	// FailOpen lets requests through unlimited while the store is unreachable
+	FailOpen RateFailPolicy = iota
+	// FailClosed rejects requests with 503 while the store is unreachable
+	FailClosed
+)
+
+// rateCleaner is implemented by stores that need expired counters removed periodically
+type rateCleaner interface {
+	Cleanup() (int, error)
+}
+
+// MemoryRateStore keeps counters in process memory. It suits a single instance
+// and tests, several instances need a shared store such as RedisRateStore.
+type MemoryRateStore struct {
+	mu       sync.Mutex
+	counters map[string]*rateCounter
+}
+
+type rateCounter struct {
+	count   int64
+	expires time.Time
+}
+
+// NewMemoryRateStore creates an empty MemoryRateStore
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{counters: make(map[string]*rateCounter)}
+}
+
+// Increment implements RateStore
+func (s *MemoryRateStore) Increment(_ context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter, ok := s.counters[key]
+	if !ok || !now.Before(counter.expires) {
+		counter = &rateCounter{expires: now.Add(window)}
+		s.counters[key] = counter
+	}
+	counter.count++
+	return counter.count, counter.expires.Sub(now), nil
+}
+
+// Cleanup removes expired counters and returns how many were removed
+func (s *MemoryRateStore) Cleanup() (int, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for key, counter := range s.counters {
+		if !now.Before(counter.expires) {
+			delete(s.counters, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
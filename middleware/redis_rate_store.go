@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisRateStoreConfig configures RedisRateStore. Zero values fall back to the defaults.
+type RedisRateStoreConfig struct {
+	// Addr is the server address, "localhost:6379" by default
+	Addr string
+	// Username and Password are sent with AUTH when Password is set
+	Username string
+	Password string
+	// DB is selected on every new connection
+	DB int
+	// KeyPrefix is prepended to every key, "ratelimit:" by default
+	KeyPrefix string
+	// PoolSize is the number of idle connections kept, 10 by default
+	PoolSize int
+	// DialTimeout is 1 second by default
+	DialTimeout time.Duration
+	// Timeout bounds every command unless the request context ends sooner, 500ms by default
+	Timeout time.Duration
+}
+
+// RedisRateStore keeps counters in Redis, or any server speaking its protocol,
+// so that all instances behind a load balancer share their limits.
+type RedisRateStore struct {
+	config RedisRateStoreConfig
+	idle   chan *respConn
+}
+
+// NewRedisRateStore creates a RedisRateStore. Connections are opened on demand.
+func NewRedisRateStore(config RedisRateStoreConfig) *RedisRateStore {
+	if config.Addr == "" {
+		config.Addr = "localhost:6379"
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = "ratelimit:"
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = 10
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 500 * time.Millisecond
+	}
+	return &RedisRateStore{config: config, idle: make(chan *respConn, config.PoolSize)}
+}
+
+// Increment implements RateStore. The counter is created with its expiry and incremented
+// in one transaction, so it never outlives its window.
+func (s *RedisRateStore) Increment(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	key = s.config.KeyPrefix + key
+	windowMs := strconv.FormatInt(max(window.Milliseconds(), 1), 10)
+	conn.send("MULTI")
+	conn.send("SET", key, "0", "PX", windowMs, "NX")
+	conn.send("INCR", key)
+	conn.send("PTTL", key)
+	conn.send("EXEC")
+	replies, err := conn.roundTrip(5)
+	if err != nil {
+		conn.Close()
+		return 0, 0, err
+	}
+	s.release(conn)
+
+	results, ok := replies[4].([]any)
+	if !ok || len(results) != 3 {
+		return 0, 0, fmt.Errorf("redis rate store: unexpected EXEC reply %v", replies[4])
+	}
+	for _, result := range results {
+		if e, ok := result.(respError); ok {
+			return 0, 0, e
+		}
+	}
+	count, ok := results[1].(int64)
+	if !ok {
+		return 0, 0, fmt.Errorf("redis rate store: unexpected INCR reply %v", results[1])
+	}
+	ttl, _ := results[2].(int64)
+	if ttl < 0 {
+		ttl = window.Milliseconds()
+	}
+	return count, time.Duration(ttl) * time.Millisecond, nil
+}
+
+// Close closes the idle connections
+func (s *RedisRateStore) Close() error {
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// conn takes an idle connection or dials a new one, and sets its deadline for one command
+func (s *RedisRateStore) conn(ctx context.Context) (*respConn, error) {
+	deadline := time.Now().Add(s.config.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	var conn *respConn
+	select {
+	case conn = <-s.idle:
+	default:
+		var err error
+		if conn, err = s.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *RedisRateStore) dial(ctx context.Context) (*respConn, error) {
+	dialer := net.Dialer{Timeout: s.config.DialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", s.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := newRespConn(netConn)
+
+	commands := 0
+	if s.config.Password != "" {
+		if s.config.Username != "" {
+			conn.send("AUTH", s.config.Username, s.config.Password)
+		} else {
+			conn.send("AUTH", s.config.Password)
+		}
+		commands++
+	}
+	if s.config.DB != 0 {
+		conn.send("SELECT", strconv.Itoa(s.config.DB))
+		commands++
+	}
+	if commands > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.config.DialTimeout))
+		if _, err := conn.roundTrip(commands); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// release returns conn to the pool, or closes it when the pool is full
+func (s *RedisRateStore) release(conn *respConn) {
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// respError is an error reply from the server
+type respError string
+
+func (e respError) Error() string {
+	return "redis: " + string(e)
+}
+
+// respConn is a connection speaking RESP2, the Redis serialization protocol
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newRespConn(conn net.Conn) *respConn {
+	return &respConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// send buffers a command, roundTrip writes it
+func (c *respConn) send(args ...string) {
+	c.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		c.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+}
+
+// roundTrip writes the buffered commands and reads n replies. It returns the first
+// error reply after reading all of them, so the connection stays usable.
+func (c *respConn) roundTrip(n int) ([]any, error) {
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]any, n)
+	var replyErr error
+	for i := range replies {
+		reply, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := reply.(respError); ok && replyErr == nil {
+			replyErr = e
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// read parses one reply into a string, respError, int64, []byte, []any or nil
+func (c *respConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return respError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]any, size)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
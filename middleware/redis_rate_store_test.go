@@ -0,0 +1,335 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	"github.com/valyala/fasthttp"
+)
+
+// fakeRedis serves the commands RedisRateStore sends over RESP from memory
+type fakeRedis struct {
+	addr string
+
+	mu      sync.Mutex
+	values  map[string]int64
+	expires map[string]time.Time
+	dials   int
+	// execReply replaces the reply to EXEC when set, to simulate a broken server
+	execReply string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	f := &fakeRedis{
+		addr:    ln.Addr().String(),
+		values:  make(map[string]int64),
+		expires: make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.dials++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch args[0] {
+		case "MULTI":
+			queued, reply = [][]string{}, "+OK\r\n"
+		case "EXEC":
+			f.mu.Lock()
+			if f.execReply != "" {
+				reply = f.execReply
+			} else {
+				reply = "*" + strconv.Itoa(len(queued)) + "\r\n"
+				for _, command := range queued {
+					reply += f.exec(command)
+				}
+			}
+			f.mu.Unlock()
+			queued = nil
+		default:
+			if queued != nil {
+				queued, reply = append(queued, args), "+QUEUED\r\n"
+			} else {
+				f.mu.Lock()
+				reply = f.exec(args)
+				f.mu.Unlock()
+			}
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+// exec runs one command, f.mu must be held
+func (f *fakeRedis) exec(args []string) string {
+	now := time.Now()
+	if len(args) > 1 {
+		if expires, ok := f.expires[args[1]]; ok && !now.Before(expires) {
+			delete(f.values, args[1])
+			delete(f.expires, args[1])
+		}
+	}
+	switch args[0] {
+	case "SET":
+		if _, ok := f.values[args[1]]; ok {
+			return "$-1\r\n"
+		}
+		ms, _ := strconv.Atoi(args[4])
+		f.values[args[1]] = 0
+		f.expires[args[1]] = now.Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case "INCR":
+		f.values[args[1]]++
+		return ":" + strconv.FormatInt(f.values[args[1]], 10) + "\r\n"
+	case "PTTL":
+		expires, ok := f.expires[args[1]]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return ":" + strconv.FormatInt(expires.Sub(now).Milliseconds(), 10) + "\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestRedisRateStoreIncrement(t *testing.T) {
+	server := newFakeRedis(t)
+	store := NewRedisRateStore(RedisRateStoreConfig{Addr: server.addr})
+	defer store.Close()
+	ctx := context.Background()
+	window := 200 * time.Millisecond
+
+	for want := int64(1); want <= 3; want++ {
+		count, ttl, err := store.Increment(ctx, "client", window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Fatalf("count = %d, want %d", count, want)
+		}
+		if ttl <= 0 || ttl > window {
+			t.Fatalf("ttl = %v, want within (0, %v]", ttl, window)
+		}
+	}
+
+	server.mu.Lock()
+	_, prefixed := server.values["ratelimit:client"]
+	dials := server.dials
+	server.mu.Unlock()
+	if !prefixed {
+		t.Fatal("counter is not stored under the key prefix")
+	}
+	if dials != 1 {
+		t.Fatalf("dials = %d, want the connection to be reused", dials)
+	}
+
+	time.Sleep(window + 50*time.Millisecond)
+	count, _, err := store.Increment(ctx, "client", window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("count after the window = %d, want 1", count)
+	}
+}
+
+func TestRedisRateStoreUnavailable(t *testing.T) {
+	// A closed listener leaves an address nobody answers on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	tests := []struct {
+		policy RateFailPolicy
+		want   int
+	}{
+		{FailOpen, fasthttp.StatusOK},
+		{FailClosed, fasthttp.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		store := NewRedisRateStore(RedisRateStoreConfig{Addr: addr, DialTimeout: 100 * time.Millisecond})
+		router := closure.NewRouter()
+		cluster := closure.NewCluster("/", router, *RateLimitMiddleware(RateLimitConfig{
+			Limit:        1,
+			Store:        store,
+			Name:         "api",
+			OnStoreError: test.policy,
+		}))
+		cluster.Get("/", func(ctx *closure.Context) error { return nil })
+
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI("/")
+		router.ServeHTTP(&ctx)
+		if status := ctx.Response.StatusCode(); status != test.want {
+			t.Errorf("policy %d: status = %d, want %d", test.policy, status, test.want)
+		}
+	}
+}
+
+func TestRedisRateStoreMalformedReply(t *testing.T) {
+	replies := map[string]string{
+		"garbage":       "garbage\r\n",
+		"unknown type":  "!3\r\n",
+		"short EXEC":    "*2\r\n:1\r\n:100\r\n",
+		"non-integer":   "*3\r\n+OK\r\n+one\r\n:100\r\n",
+		"error reply":   "*3\r\n+OK\r\n-WRONGTYPE not an integer\r\n:100\r\n",
+		"aborted EXEC":  "*-1\r\n",
+		"unterminated":  ":1\n",
+		"bad integer":   "*3\r\n+OK\r\n:x\r\n:100\r\n",
+		"bad bulk size": "$x\r\n",
+	}
+	for name, reply := range replies {
+		t.Run(name, func(t *testing.T) {
+			server := newFakeRedis(t)
+			server.mu.Lock()
+			server.execReply = reply
+			server.mu.Unlock()
+			store := NewRedisRateStore(RedisRateStoreConfig{Addr: server.addr, Timeout: 200 * time.Millisecond})
+			defer store.Close()
+
+			if count, _, err := store.Increment(context.Background(), "client", time.Second); err == nil {
+				t.Fatalf("count = %d, want an error", count)
+			}
+
+			// The store recovers once the server answers properly again
+			server.mu.Lock()
+			server.execReply = ""
+			server.mu.Unlock()
+			count, _, err := store.Increment(context.Background(), "client", time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count < 1 {
+				t.Fatalf("count = %d, want at least 1", count)
+			}
+		})
+	}
+}
+
+func TestRateLimitStoreRejectsSlidingWindow(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("RateLimitMiddleware accepted SlidingWindow with a Store")
+		}
+	}()
+	RateLimitMiddleware(RateLimitConfig{Algorithm: SlidingWindow, Store: NewMemoryRateStore(), Name: "api"})
+}
+
+func TestRateLimitStoreLimitsRequests(t *testing.T) {
+	server := newFakeRedis(t)
+	store := NewRedisRateStore(RedisRateStoreConfig{Addr: server.addr})
+	defer store.Close()
+
+	router := closure.NewRouter()
+	login := closure.NewCluster("/login", router, *RateLimitMiddleware(RateLimitConfig{
+		Limit: 2, Window: time.Minute, Store: store, Name: "login",
+	}))
+	login.Get("/", func(ctx *closure.Context) error { return nil })
+	api := closure.NewCluster("/api", router, *RateLimitMiddleware(RateLimitConfig{
+		Limit: 3, Window: time.Minute, Store: store, Name: "api",
+	}))
+	api.Get("/", func(ctx *closure.Context) error { return nil })
+
+	request := func(path string) *fasthttp.Response {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(path)
+		router.ServeHTTP(&ctx)
+		return &ctx.Response
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := request("/login").StatusCode(); status != fasthttp.StatusOK {
+			t.Fatalf("login request %d: status = %d, want 200", i+1, status)
+		}
+	}
+	resp := request("/login")
+	if status := resp.StatusCode(); status != fasthttp.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", status)
+	}
+	retryAfter, err := strconv.Atoi(string(resp.Header.Peek("Retry-After")))
+	if err != nil || retryAfter < 1 || retryAfter > 60 {
+		t.Fatalf("Retry-After = %q, want seconds within the window", resp.Header.Peek("Retry-After"))
+	}
+	if remaining := string(resp.Header.Peek("RateLimit-Remaining")); remaining != "0" {
+		t.Fatalf("RateLimit-Remaining = %q, want 0", remaining)
+	}
+
+	// The other limiter on the store counts the same client separately
+	for i := 0; i < 3; i++ {
+		if status := request("/api").StatusCode(); status != fasthttp.StatusOK {
+			t.Fatalf("api request %d: status = %d, want 200", i+1, status)
+		}
+	}
+	if status := request("/api").StatusCode(); status != fasthttp.StatusTooManyRequests {
+		t.Fatalf("api status = %d, want 429", status)
+	}
+}
+
+func TestRateLimitStoreRequiresName(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("RateLimitMiddleware accepted a Store without a Name")
+		}
+	}()
+	RateLimitMiddleware(RateLimitConfig{Store: NewMemoryRateStore()})
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// RevocationStore is a denylist of token ids. JWTMiddleware rejects tokens whose jti
+// or family is on it, TokenService also uses it to rotate refresh tokens only once and
+// DigestAuthMiddleware to accept each nonce count only once.
+// Implementations must be safe for concurrent use.
+type RevocationStore interface {
+	// Revoke denies id until expires, when the token would expire anyway. It reports
+	// whether id was newly revoked, atomically, so that only one caller wins.
+	Revoke(ctx context.Context, id string, expires time.Time) (bool, error)
+	// IsRevoked reports whether id is denied
+	IsRevoked(ctx context.Context, id string) (bool, error)
+}
+
+// isTokenRevoked checks the jti and the token family, which is revoked as a whole
+// when a refresh token is reused
+func isTokenRevoked(ctx context.Context, store RevocationStore, claims jwt.MapClaims) (bool, error) {
+	for _, claim := range []string{"jti", "fam"} {
+		id, _ := claims[claim].(string)
+		if id == "" {
+			continue
+		}
+		if revoked, err := store.IsRevoked(ctx, claim+":"+id); err != nil || revoked {
+			return revoked, err
+		}
+	}
+	return false, nil
+}
+
+// revocationCleaner is implemented by stores that need expired ids removed periodically
+type revocationCleaner interface {
+	Cleanup() (int, error)
+}
+
+// MemoryRevocationStore keeps the denylist in process memory, for a single instance
+type MemoryRevocationStore struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// NewMemoryRevocationStore creates an empty MemoryRevocationStore
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{revoked: make(map[string]time.Time)}
+}
+
+// Revoke implements RevocationStore
+func (s *MemoryRevocationStore) Revoke(_ context.Context, id string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if until, ok := s.revoked[id]; ok && time.Now().Before(until) {
+		if expires.After(until) {
+			s.revoked[id] = expires
+		}
+		return false, nil
+	}
+	s.revoked[id] = expires
+	return true, nil
+}
+
+// IsRevoked implements RevocationStore
+func (s *MemoryRevocationStore) IsRevoked(_ context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.revoked[id]
+	return ok && time.Now().Before(until), nil
+}
+
+// Cleanup removes ids whose tokens have expired and returns how many were removed
+func (s *MemoryRevocationStore) Cleanup() (int, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for id, until := range s.revoked {
+		if !now.Before(until) {
+			delete(s.revoked, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
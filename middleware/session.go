@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+)
+
+// SessionConfig configures SessionMiddleware. Zero values fall back to the defaults.
+type SessionConfig struct {
+	Store closure.SessionStore
+	// CookieName defaults to "session_id"
+	CookieName string
+	// IdleTimeout expires sessions without activity, 30 minutes by default
+	IdleTimeout time.Duration
+	// AbsoluteTimeout expires sessions regardless of activity, 24 hours by default
+	AbsoluteTimeout time.Duration
+	// Keys signs the session cookie when set
+	Keys          *closure.CookieKeys
+	CookieOptions []closure.CookieOption
+	// SweepInterval is how often expired sessions are removed from stores with a
+	// Cleanup method, such as FileSessionStore, 10 minutes by default
+	SweepInterval time.Duration
+}
+
+// sessionCleaner is implemented by stores that remove expired sessions on demand
+type sessionCleaner interface {
+	Cleanup() (int, error)
+}
+
+// SessionMiddleware loads the session named by the cookie, exposes it through
+// ctx.Session() and saves it once the handler returns. The sweeper of stores with a
+// Cleanup method starts with the first request and stops with the App.
+func SessionMiddleware(config SessionConfig) *closure.Middleware {
+	if config.Store == nil {
+		config.Store = closure.NewMemorySessionStore(0)
+	}
+	if config.CookieName == "" {
+		config.CookieName = "session_id"
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = 30 * time.Minute
+	}
+	if config.AbsoluteTimeout <= 0 {
+		config.AbsoluteTimeout = 24 * time.Hour
+	}
+	if config.SweepInterval <= 0 {
+		config.SweepInterval = 10 * time.Minute
+	}
+	var sweeper sync.Once
+
+	return &closure.Middleware{
+		Name: "Session",
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				sweeper.Do(func() {
+					if cleaner, ok := config.Store.(sessionCleaner); ok {
+						go sweepSessions(ctx.ServerContext(), cleaner, config.SweepInterval)
+					}
+				})
+				session, err := loadSession(ctx, config)
+				if err != nil {
+					return err
+				}
+				closure.SessionKey.Set(ctx, session)
+
+				handlerErr := next(ctx)
+				if err := saveSession(ctx, session, config); err != nil {
+					logging.Error("session save failed: %s", err.Error())
+				}
+				return handlerErr
+			}
+		},
+	}
+}
+
+func loadSession(ctx *closure.Context, config SessionConfig) (*closure.Session, error) {
+	id, ok := sessionCookie(ctx, config)
+	if ok {
+		record, err := config.Store.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			session := closure.LoadedSession(id, record)
+			if !session.Expired(time.Now(), config.IdleTimeout, config.AbsoluteTimeout) {
+				return session, nil
+			}
+			_ = config.Store.Delete(id)
+		}
+	}
+	return closure.NewSession()
+}
+
+func saveSession(ctx *closure.Context, session *closure.Session, config SessionConfig) error {
+	if session.Destroyed() {
+		ctx.DeleteCookie(config.CookieName, config.CookieOptions...)
+		if session.IsNew() {
+			return nil
+		}
+		if err := config.Store.Delete(session.ID()); err != nil {
+			return err
+		}
+		if previous := session.PreviousID(); previous != "" {
+			return config.Store.Delete(previous)
+		}
+		return nil
+	}
+
+	// Untouched new sessions are not persisted, so anonymous visitors cost nothing
+	if session.IsNew() && !session.Changed() {
+		return nil
+	}
+
+	if previous := session.PreviousID(); previous != "" {
+		if err := config.Store.Delete(previous); err != nil {
+			return err
+		}
+	}
+
+	session.Touch(time.Now())
+	if err := config.Store.Save(session.ID(), session.Record(), config.IdleTimeout); err != nil {
+		return err
+	}
+
+	if session.IsNew() || session.Regenerated() {
+		setSessionCookie(ctx, session.ID(), config)
+	}
+	return nil
+}
+
+func sessionCookie(ctx *closure.Context, config SessionConfig) (string, bool) {
+	if config.Keys != nil {
+		id, err := ctx.SignedCookie(config.Keys, config.CookieName)
+		return id, err == nil
+	}
+	return ctx.Cookie(config.CookieName)
+}
+
+func setSessionCookie(ctx *closure.Context, id string, config SessionConfig) {
+	opts := append([]closure.CookieOption{closure.WithCookieMaxAge(config.AbsoluteTimeout)}, config.CookieOptions...)
+	if config.Keys != nil {
+		ctx.SetSignedCookie(config.Keys, config.CookieName, id, opts...)
+		return
+	}
+	ctx.SetCookie(config.CookieName, id, opts...)
+}
+
+// sweepSessions removes expired sessions every interval until ctx is done
+func sweepSessions(ctx context.Context, cleaner sessionCleaner, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := cleaner.Cleanup(); err != nil {
+				logging.Error("session cleanup failed: %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	"github.com/valyala/fasthttp"
+)
+
+// TimeoutMiddleware bounds a route by attaching a deadline to ctx.Context().
+// When the deadline passes the client gets 504, and 503 when the server is shutting down.
+// Handlers should pass ctx.Context() to blocking calls so they stop once the response is sent.
+// A handler that overruns keeps running in the background and owns the request until it
+// returns, the OnDone cleanups wait for it. Register it innermost on a route so no other
+// middleware touches the response while such a handler may still be writing it.
+func TimeoutMiddleware(timeout time.Duration) *closure.Middleware {
+	return &closure.Middleware{
+		Name: "Timeout",
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				reqCtx, cancel := context.WithTimeout(ctx.Context(), timeout)
+				ctx.SetContext(reqCtx)
+				ctx.OnDone(cancel)
+
+				done := make(chan error, 1)
+				go func() {
+					defer func() {
+						if rec := recover(); rec != nil {
+							done <- fmt.Errorf("panic: %v", rec)
+						}
+					}()
+					done <- next(ctx)
+				}()
+
+				select {
+				case err := <-done:
+					return err
+				case <-reqCtx.Done():
+					// The cleanups wait for the handler, and ctx is left to it from here on
+					release := ctx.Hold()
+					go func() {
+						<-done
+						release()
+					}()
+					if errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+						ctx.TimeoutErrorWithCode("Gateway Timeout", fasthttp.StatusGatewayTimeout)
+					} else {
+						ctx.TimeoutErrorWithCode("Service Unavailable", fasthttp.StatusServiceUnavailable)
+					}
+					return nil
+				}
+			}
+		},
+	}
+}
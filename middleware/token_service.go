@@ -0,0 +1,387 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	logging "github.com/SwanHtetAungPhyo/swantemp/log"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+)
+
+var tokenServiceKey = closure.NewKey[*TokenService]("token_service")
+
+// ErrRefreshTokenReused is returned when a rotated refresh token is presented again.
+// The whole token family is revoked, since the token has likely been stolen.
+var ErrRefreshTokenReused = errors.New("refresh token was already used")
+
+var (
+	errNotRefreshToken = errors.New("token is not a refresh token")
+	// errRevocationStore marks failures of the RevocationStore, as opposed to bad tokens
+	errRevocationStore = errors.New("revocation store failed")
+)
+
+// TokenServiceConfig configures a TokenService. Zero values fall back to the defaults.
+type TokenServiceConfig struct {
+	// SigningKey signs the tokens: a []byte or string secret for HMAC, or a private key
+	// implementing crypto.Signer for the other methods
+	SigningKey any
+	// SigningMethod is HS256 by default
+	SigningMethod jwt.SigningMethod
+	// KeyID is sent as the kid header, e.g. to match a JWKS entry
+	KeyID string
+	// Issuer and Audience are set on every token and checked when verifying
+	Issuer   string
+	Audience []string
+	// AccessTTL is 15 minutes by default
+	AccessTTL time.Duration
+	// RefreshTTL is 30 days by default
+	RefreshTTL time.Duration
+	// Revocations holds revoked and rotated token ids, a MemoryRevocationStore by default
+	Revocations RevocationStore
+	// Leeway tolerates clock skew when verifying
+	Leeway time.Duration
+}
+
+// TokenPair is the response of a login or refresh
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// TokenService issues access and refresh token pairs. Refresh tokens are rotated on
+// every use: a token and its successors form a family, and reusing a rotated token
+// revokes the family. Tokens carry a typ claim of "access" or "refresh", other
+// verifiers of the access tokens should set JWTConfig.TokenType to "access".
+type TokenService struct {
+	config TokenServiceConfig
+	verify JWTConfig
+	parser *jwt.Parser
+	// sweeper starts the cleanup of the revocation store on the first request
+	sweeper sync.Once
+}
+
+// registeredClaims are set by the service and not copied between tokens
+var registeredClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "fam", "typ"}
+
+// NewTokenService creates a TokenService, failing when the signing key does not suit the method
+func NewTokenService(config TokenServiceConfig) (*TokenService, error) {
+	if secret, ok := config.SigningKey.(string); ok {
+		config.SigningKey = []byte(secret)
+	}
+	if config.SigningMethod == nil {
+		config.SigningMethod = jwt.SigningMethodHS256
+	}
+	if config.AccessTTL <= 0 {
+		config.AccessTTL = 15 * time.Minute
+	}
+	if config.RefreshTTL <= 0 {
+		config.RefreshTTL = 30 * 24 * time.Hour
+	}
+	if config.Revocations == nil {
+		config.Revocations = NewMemoryRevocationStore()
+	}
+
+	verifyKey := config.SigningKey
+	if signer, ok := config.SigningKey.(crypto.Signer); ok {
+		verifyKey = signer.Public()
+	}
+	if _, err := jwt.New(config.SigningMethod).SignedString(config.SigningKey); err != nil {
+		return nil, err
+	}
+
+	s := &TokenService{config: config}
+	s.verify = JWTConfig{
+		Key:         verifyKey,
+		Algorithms:  []string{config.SigningMethod.Alg()},
+		Issuer:      config.Issuer,
+		Audience:    config.Audience,
+		Leeway:      config.Leeway,
+		Revocations: config.Revocations,
+		TokenType:   "access",
+	}
+	s.parser = jwt.NewParser(jwt.WithValidMethods(s.verify.Algorithms), jwt.WithoutClaimsValidation())
+	return s, nil
+}
+
+// Issue creates a token pair for subject starting a new family. The extra claims,
+// e.g. roles and scope, are carried into every refreshed access token.
+func (s *TokenService) Issue(subject string, claims jwt.MapClaims) (*TokenPair, error) {
+	family, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	extra := maps.Clone(claims)
+	for _, name := range registeredClaims {
+		delete(extra, name)
+	}
+	return s.issue(subject, family, extra)
+}
+
+func (s *TokenService) issue(subject, family string, extra jwt.MapClaims) (*TokenPair, error) {
+	now := time.Now()
+	access, err := s.sign(subject, family, extra, now, now.Add(s.config.AccessTTL), "access")
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := s.sign(subject, family, extra, now, now.Add(s.config.RefreshTTL), "refresh")
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.config.AccessTTL.Seconds()),
+	}, nil
+}
+
+func (s *TokenService) sign(subject, family string, extra jwt.MapClaims, now, expires time.Time, typ string) (string, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	claims := maps.Clone(extra)
+	if claims == nil {
+		claims = jwt.MapClaims{}
+	}
+	claims["sub"] = subject
+	claims["iat"] = now.Unix()
+	claims["exp"] = expires.Unix()
+	claims["jti"] = id
+	claims["fam"] = family
+	if s.config.Issuer != "" {
+		claims["iss"] = s.config.Issuer
+	}
+	if len(s.config.Audience) > 0 {
+		claims["aud"] = s.config.Audience
+	}
+	claims["typ"] = typ
+
+	token := jwt.NewWithClaims(s.config.SigningMethod, claims)
+	if s.config.KeyID != "" {
+		token.Header["kid"] = s.config.KeyID
+	}
+	return token.SignedString(s.config.SigningKey)
+}
+
+// Refresh exchanges a refresh token for a new pair. The presented token can not be
+// used again, presenting it twice returns ErrRefreshTokenReused and revokes its family.
+// The new pair is signed before the presented token is rotated, so a failure to sign
+// leaves the presented token usable for a retry.
+func (s *TokenService) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	claims, err := s.parse(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims["typ"] != "refresh" {
+		return nil, errNotRefreshToken
+	}
+	id, _ := claims["jti"].(string)
+	family, _ := claims["fam"].(string)
+	if id == "" || family == "" {
+		return nil, errTokenSignature
+	}
+	if revoked, err := s.config.Revocations.IsRevoked(ctx, "fam:"+family); err != nil {
+		return nil, fmt.Errorf("%w: %w", errRevocationStore, err)
+	} else if revoked {
+		return nil, errTokenRevoked
+	}
+
+	subject, _ := claims["sub"].(string)
+	expires := s.expiry(claims)
+	for _, name := range registeredClaims {
+		delete(claims, name)
+	}
+	pair, err := s.issue(subject, family, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	rotated, err := s.config.Revocations.Revoke(ctx, "jti:"+id, expires)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errRevocationStore, err)
+	}
+	if !rotated {
+		// Successors of the token live at most RefreshTTL from now
+		if _, err := s.config.Revocations.Revoke(ctx, "fam:"+family, time.Now().Add(s.config.RefreshTTL)); err != nil {
+			return nil, fmt.Errorf("%w: %w", errRevocationStore, err)
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	return pair, nil
+}
+
+// Revoke revokes a token issued by the service until it expires. Revoking a refresh
+// token revokes its whole family, e.g. on logout.
+func (s *TokenService) Revoke(ctx context.Context, token string) error {
+	claims, err := s.parse(token)
+	if err != nil {
+		return err
+	}
+	id, _ := claims["jti"].(string)
+	if claims["typ"] == "refresh" {
+		id, _ = claims["fam"].(string)
+		_, err = s.config.Revocations.Revoke(ctx, "fam:"+id, time.Now().Add(s.config.RefreshTTL))
+		return err
+	}
+	_, err = s.config.Revocations.Revoke(ctx, "jti:"+id, s.expiry(claims))
+	return err
+}
+
+// parse verifies the signature and the registered claims of a token issued by the service
+func (s *TokenService) parse(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, err := s.parser.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return s.verify.Key, nil
+	}); err != nil {
+		return nil, errTokenSignature
+	}
+	if err := validateClaims(claims, s.verify, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Middleware verifies access tokens issued by the service, including their revocation,
+// and makes the service available to handlers through TokenServiceFrom
+func (s *TokenService) Middleware() *closure.Middleware {
+	verify := JWTMiddleware(s.verify)
+	return &closure.Middleware{
+		Name: "JWT",
+		Handler: func(next closure.Handler) closure.Handler {
+			return s.Provide().Handler(verify.Handler(next))
+		},
+	}
+}
+
+// Provide makes the service available to handlers through TokenServiceFrom without
+// verifying anything, e.g. for a cluster serving /auth/login and /auth/refresh
+func (s *TokenService) Provide() *closure.Middleware {
+	return &closure.Middleware{
+		Name: "TokenService",
+		Handler: func(next closure.Handler) closure.Handler {
+			return func(ctx *closure.Context) error {
+				s.sweeper.Do(func() {
+					if cleaner, ok := s.config.Revocations.(revocationCleaner); ok {
+						go sweepRevocations(ctx.ServerContext(), cleaner, s.config.AccessTTL)
+					}
+				})
+				tokenServiceKey.Set(ctx, s)
+				return next(ctx)
+			}
+		},
+	}
+}
+
+// String describes the service without its keys, e.g. when a logger prints request locals
+func (s *TokenService) String() string {
+	return "TokenService(" + s.config.SigningMethod.Alg() + ")"
+}
+
+// TokenServiceFrom returns the service provided by TokenService.Provide or Middleware
+func TokenServiceFrom(ctx *closure.Context) (*TokenService, bool) {
+	return tokenServiceKey.Get(ctx)
+}
+
+// LoginHandler responds with a new token pair for the subject that authenticate returns.
+// Errors from authenticate are returned as they are, e.g. a 401 HTTPError.
+func (s *TokenService) LoginHandler(authenticate func(ctx *closure.Context) (string, jwt.MapClaims, error)) closure.Handler {
+	return func(ctx *closure.Context) error {
+		subject, claims, err := authenticate(ctx)
+		if err != nil {
+			return err
+		}
+		pair, err := s.Issue(subject, claims)
+		if err != nil {
+			return err
+		}
+		return closure.JSONMe(ctx, fasthttp.StatusOK, "login successful", pair)
+	}
+}
+
+// RefreshHandler exchanges the refresh_token of a JSON body for a new token pair.
+// Invalid tokens get 401, a failing RevocationStore gets 503 so that clients retry
+// instead of ending the session.
+func (s *TokenService) RefreshHandler() closure.Handler {
+	return func(ctx *closure.Context) error {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := closure.Binder(ctx, &body); err != nil || body.RefreshToken == "" {
+			return closure.NewHTTPError(fasthttp.StatusBadRequest, "refresh_token is required")
+		}
+		pair, err := s.Refresh(ctx.Context(), body.RefreshToken)
+		switch {
+		case err == nil:
+		case errors.Is(err, errRevocationStore):
+			logging.Error("token refresh failed: %s", err.Error())
+			return closure.NewHTTPError(fasthttp.StatusServiceUnavailable, "Service Unavailable")
+		case errors.Is(err, ErrRefreshTokenReused):
+			logging.Warn("refresh token reused, token family revoked")
+			return closure.NewHTTPError(fasthttp.StatusUnauthorized, err.Error())
+		case isTokenError(err):
+			return closure.NewHTTPError(fasthttp.StatusUnauthorized, err.Error())
+		default:
+			logging.Error("token refresh failed: %s", err.Error())
+			return closure.NewHTTPError(fasthttp.StatusInternalServerError, "Internal Server Error")
+		}
+		return closure.JSONMe(ctx, fasthttp.StatusOK, "token refreshed", pair)
+	}
+}
+
+// isTokenError reports whether err is about the presented token rather than the service
+func isTokenError(err error) bool {
+	for _, tokenErr := range []error{
+		errNotRefreshToken, errTokenSignature, errTokenRevoked, errTokenExpired, errTokenNoExpiry,
+		errTokenBadExpiry, errTokenNotYet, errTokenIssuedAt, errTokenIssuer, errTokenAudience,
+	} {
+		if errors.Is(err, tokenErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweepRevocations removes expired ids every interval until ctx is done
+func sweepRevocations(ctx context.Context, cleaner revocationCleaner, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := cleaner.Cleanup(); err != nil {
+				logging.Error("revocation cleanup failed: %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expiry returns when a token expires, so that its revocation can be forgotten then
+func (s *TokenService) expiry(claims jwt.MapClaims) time.Time {
+	if seconds, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(seconds), 0).Add(s.config.Leeway)
+	}
+	return time.Now().Add(s.config.RefreshTTL)
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
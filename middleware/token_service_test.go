@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SwanHtetAungPhyo/swantemp/closure"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+)
+
+// failingRevocations is a RevocationStore whose backend is down
+type failingRevocations struct{}
+
+func (failingRevocations) Revoke(context.Context, string, time.Time) (bool, error) {
+	return false, errors.New("dial tcp 10.0.0.7:6379: connection refused")
+}
+
+func (failingRevocations) IsRevoked(context.Context, string) (bool, error) {
+	return false, errors.New("dial tcp 10.0.0.7:6379: connection refused")
+}
+
+func newTestTokenService(t *testing.T, revocations RevocationStore) *TokenService {
+	t.Helper()
+	service, err := NewTokenService(TokenServiceConfig{
+		SigningKey:  "0123456789abcdef0123456789abcdef",
+		Issuer:      "closure-test",
+		Revocations: revocations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// tokenRouter serves /me behind the service middleware and /refresh through RefreshHandler
+func tokenRouter(service *TokenService) *closure.Router {
+	router := closure.NewRouter()
+	protected := closure.NewCluster("/", router, *service.Middleware())
+	protected.Get("/me", func(ctx *closure.Context) error {
+		claims, _ := JWTClaimsKey.Get(ctx)
+		ctx.SetBodyString(claims["sub"].(string) + " " + claims["role"].(string))
+		return nil
+	})
+	public := closure.NewCluster("/", router, *service.Provide())
+	public.Post("/refresh", service.RefreshHandler())
+	return router
+}
+
+func getWithToken(router *closure.Router, token string) *fasthttp.Response {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/me")
+	ctx.Request.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(&ctx)
+	return &ctx.Response
+}
+
+func postRefresh(router *closure.Router, token string) *fasthttp.Response {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetRequestURI("/refresh")
+	ctx.Request.Header.SetContentType("application/json")
+	ctx.Request.SetBodyString(`{"refresh_token":"` + token + `"}`)
+	router.ServeHTTP(&ctx)
+	return &ctx.Response
+}
+
+func TestTokenServiceIssue(t *testing.T) {
+	service := newTestTokenService(t, nil)
+	router := tokenRouter(service)
+
+	pair, err := service.Issue("alice", jwt.MapClaims{"role": "admin", "sub": "mallory", "typ": "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := getWithToken(router, pair.AccessToken)
+	if status := resp.StatusCode(); status != fasthttp.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if body := string(resp.Body()); body != "alice admin" {
+		t.Fatalf("body = %q, want the subject and the extra claims", body)
+	}
+
+	if status := getWithToken(router, pair.RefreshToken).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("refresh token used as access token: status = %d, want 401", status)
+	}
+}
+
+func TestTokenServiceRefreshRotates(t *testing.T) {
+	service := newTestTokenService(t, nil)
+	router := tokenRouter(service)
+	pair, err := service.Issue("alice", jwt.MapClaims{"role": "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := service.Refresh(context.Background(), pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.RefreshToken == pair.RefreshToken || rotated.AccessToken == pair.AccessToken {
+		t.Fatal("refresh returned the presented tokens")
+	}
+	if body := string(getWithToken(router, rotated.AccessToken).Body()); body != "alice admin" {
+		t.Fatalf("body = %q, want the claims carried into the refreshed token", body)
+	}
+
+	if status := postRefresh(router, rotated.RefreshToken).StatusCode(); status != fasthttp.StatusOK {
+		t.Fatalf("refresh through the handler: status = %d, want 200", status)
+	}
+	if status := postRefresh(router, "not-a-token").StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("invalid token: status = %d, want 401", status)
+	}
+	if status := postRefresh(router, pair.AccessToken).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("access token presented for refresh: status = %d, want 401", status)
+	}
+}
+
+func TestTokenServiceReuseRevokesFamily(t *testing.T) {
+	service := newTestTokenService(t, nil)
+	router := tokenRouter(service)
+	pair, err := service.Issue("alice", jwt.MapClaims{"role": "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := service.Refresh(context.Background(), pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stolen original is presented again
+	if _, err := service.Refresh(context.Background(), pair.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("err = %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := service.Refresh(context.Background(), rotated.RefreshToken); err == nil {
+		t.Fatal("successor of a reused token could still be refreshed")
+	}
+	if status := getWithToken(router, rotated.AccessToken).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("access token of a revoked family: status = %d, want 401", status)
+	}
+
+	// Other families are not affected
+	other, err := service.Issue("bob", jwt.MapClaims{"role": "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := getWithToken(router, other.AccessToken).StatusCode(); status != fasthttp.StatusOK {
+		t.Fatalf("unrelated family: status = %d, want 200", status)
+	}
+}
+
+func TestTokenServiceRevoke(t *testing.T) {
+	service := newTestTokenService(t, nil)
+	router := tokenRouter(service)
+	pair, err := service.Issue("alice", jwt.MapClaims{"role": "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.Revoke(context.Background(), pair.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if status := getWithToken(router, pair.AccessToken).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("revoked access token: status = %d, want 401", status)
+	}
+	// Revoking an access token leaves the session itself alive
+	rotated, err := service.Refresh(context.Background(), pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logging out revokes the family
+	if err := service.Revoke(context.Background(), rotated.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if status := getWithToken(router, rotated.AccessToken).StatusCode(); status != fasthttp.StatusUnauthorized {
+		t.Fatalf("access token after logout: status = %d, want 401", status)
+	}
+	if _, err := service.Refresh(context.Background(), rotated.RefreshToken); !errors.Is(err, errTokenRevoked) {
+		t.Fatalf("err = %v, want the revoked refresh token to be refused", err)
+	}
+}
+
+func TestTokenServiceRefreshStoreUnavailable(t *testing.T) {
+	service := newTestTokenService(t, failingRevocations{})
+	router := tokenRouter(service)
+	pair, err := service.Issue("alice", jwt.MapClaims{"role": "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := postRefresh(router, pair.RefreshToken)
+	if status := resp.StatusCode(); status != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", status)
+	}
+	if body := string(resp.Body()); strings.Contains(body, "connection refused") {
+		t.Fatalf("body %q leaks the store error", body)
+	}
+	if status := getWithToken(router, pair.AccessToken).StatusCode(); status != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("JWTMiddleware: status = %d, want 503", status)
+	}
+}